@@ -0,0 +1,121 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// ConnWithContext returns conn with its reads and writes aborted once ctx is
+// done: the deadlines of conn are then set in the past, and the pending and
+// following reads and writes return ctx.Err() in place of the deadline error.
+// Other errors, such as io.EOF, are returned as they are. The returned conn is
+// a PacketConn if conn is. Close stops watching ctx and closes conn.
+func ConnWithContext(ctx context.Context, conn Conn) Conn {
+	c := &contextConn{
+		Conn: conn,
+		ctx:  ctx,
+		stop: make(chan struct{}),
+	}
+	go c.watch()
+	if packetConn, ok := conn.(PacketConn); ok {
+		return &contextPacketConn{contextConn: c, packetConn: packetConn}
+	}
+	return c
+}
+
+type contextConn struct {
+	Conn
+	ctx context.Context
+	// stop is closed by Close to stop watch.
+	stop      chan struct{}
+	closeOnce sync.Once
+
+	// mu guards done and the deadlines of Conn, so that setting a deadline
+	// does not revive a conn whose ctx is done.
+	mu   sync.Mutex
+	done bool
+}
+
+func (c *contextConn) watch() {
+	select {
+	case <-c.ctx.Done():
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.done = true
+		_ = c.Conn.SetDeadline(time.Unix(1, 0))
+	case <-c.stop:
+	}
+}
+
+// err returns ctx.Err() in place of err if err comes from the deadline set by
+// watch.
+func (c *contextConn) err(err error) error {
+	if err == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return c.ctx.Err()
+	}
+	return err
+}
+
+func (c *contextConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	return n, c.err(err)
+}
+
+func (c *contextConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	return n, c.err(err)
+}
+
+func (c *contextConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+	})
+	return c.Conn.Close()
+}
+
+func (c *contextConn) setDeadline(set func(t time.Time) error, t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return c.ctx.Err()
+	}
+	return set(t)
+}
+
+func (c *contextConn) SetDeadline(t time.Time) error {
+	return c.setDeadline(c.Conn.SetDeadline, t)
+}
+
+func (c *contextConn) SetReadDeadline(t time.Time) error {
+	return c.setDeadline(c.Conn.SetReadDeadline, t)
+}
+
+func (c *contextConn) SetWriteDeadline(t time.Time) error {
+	return c.setDeadline(c.Conn.SetWriteDeadline, t)
+}
+
+type contextPacketConn struct {
+	*contextConn
+	packetConn PacketConn
+}
+
+func (c *contextPacketConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	n, addr, err = c.packetConn.ReadFrom(p)
+	return n, addr, c.err(err)
+}
+
+func (c *contextPacketConn) WriteTo(p []byte, addr string) (n int, err error) {
+	n, err = c.packetConn.WriteTo(p, addr)
+	return n, c.err(err)
+}
+
+var _ PacketConn = (*contextPacketConn)(nil)
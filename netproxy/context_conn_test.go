@@ -0,0 +1,85 @@
+package netproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestConnWithContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := ConnWithContext(ctx, client)
+	defer conn.Close()
+	if _, ok := conn.(PacketConn); ok {
+		t.Fatal("a stream conn becomes a packet conn")
+	}
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the read is not aborted")
+	}
+	// The conn stays aborted.
+	if err := conn.SetDeadline(time.Time{}); !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("x")); !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+}
+
+func TestConnWithContextOtherErrors(t *testing.T) {
+	client, server := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := ConnWithContext(ctx, client)
+	defer conn.Close()
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for conn.SetDeadline(time.Time{}) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the conn is not aborted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The end of the stream is not a deadline error.
+	_ = server.Close()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+func TestConnWithContextClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		client, server := net.Pipe()
+		conn := ConnWithContext(context.Background(), client)
+		if err := conn.Close(); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+		_ = server.Close()
+	}
+	// The watchers exit once the conns are closed.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatal("watchers are left running", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -15,6 +15,40 @@ type ContextDialer interface {
 	DialContext(ctx context.Context, network, addr string) (c Conn, err error)
 }
 
+// Capabilities is a set of features supported by a Dialer.
+type Capabilities uint32
+
+const (
+	// CapabilityTcp means the Dialer dials "tcp" streams.
+	CapabilityTcp Capabilities = 1 << iota
+	// CapabilityUdp means the Dialer relays "udp" packets.
+	CapabilityUdp
+	// CapabilityContext means the Dialer implements ContextDialer.
+	CapabilityContext
+	// CapabilityMigration means connections of the Dialer survive changes of
+	// the local address.
+	CapabilityMigration
+)
+
+// Has reports whether c has all capabilities of o.
+func (c Capabilities) Has(o Capabilities) bool {
+	return c&o == o
+}
+
+// CapabilitiesDialer is implemented by dialers that report their capabilities.
+type CapabilitiesDialer interface {
+	Capabilities() Capabilities
+}
+
+// DialerCapabilities returns the capabilities of d. A Dialer not implementing
+// CapabilitiesDialer is assumed to dial TCP only.
+func DialerCapabilities(d Dialer) Capabilities {
+	if c, ok := d.(CapabilitiesDialer); ok {
+		return c.Capabilities()
+	}
+	return CapabilityTcp
+}
+
 type ContextDialerConverter struct {
 	Dialer
 }
@@ -0,0 +1,106 @@
+package netproxy
+
+import (
+	"context"
+)
+
+// DialTrace is a set of hooks to run at the phases of a dial, like
+// httptrace.ClientTrace. Any hook may be nil.
+//
+// ConnectDone, HandshakeDone and AuthDone are called by dialers supporting
+// them only if the dial establishes a new connection to the server, and not if
+// an existing one is reused. Phases a dialer does not wait for, such as the
+// handshake and the authentication of TUIC with ReduceRtt, may be done after
+// DialDone. Dialers without a phase, such as gRPC without authentication, do
+// not call its hook.
+type DialTrace struct {
+	// DialStart is called when the dial starts.
+	DialStart func(network string, addr string)
+	// ConnectDone is called when the conn to the server is dialed through the
+	// next dialer, with the error if it failed.
+	ConnectDone func(err error)
+	// HandshakeDone is called when the handshake with the server is done, with
+	// the error if it failed.
+	HandshakeDone func(err error)
+	// AuthDone is called when the authentication to the server is done, with
+	// the error if it failed.
+	AuthDone func(err error)
+	// DialDone is called when the dial returns, with the returned conn ready
+	// to use or the error.
+	DialDone func(c Conn, err error)
+}
+
+type dialTraceKey struct{}
+
+// WithDialTrace returns a copy of ctx carrying trace. A nil trace removes the
+// trace of ctx, so that the dials to the next dialer are not reported as the
+// phases of the dial.
+func WithDialTrace(ctx context.Context, trace *DialTrace) context.Context {
+	return context.WithValue(ctx, dialTraceKey{}, trace)
+}
+
+// ContextDialTrace returns the trace carried by ctx, or nil.
+func ContextDialTrace(ctx context.Context) *DialTrace {
+	trace, _ := ctx.Value(dialTraceKey{}).(*DialTrace)
+	return trace
+}
+
+// TraceConnectDone calls trace.ConnectDone if both are not nil.
+func TraceConnectDone(trace *DialTrace, err error) {
+	if trace != nil && trace.ConnectDone != nil {
+		trace.ConnectDone(err)
+	}
+}
+
+// TraceHandshakeDone calls trace.HandshakeDone if both are not nil.
+func TraceHandshakeDone(trace *DialTrace, err error) {
+	if trace != nil && trace.HandshakeDone != nil {
+		trace.HandshakeDone(err)
+	}
+}
+
+// TraceAuthDone calls trace.AuthDone if both are not nil.
+func TraceAuthDone(trace *DialTrace, err error) {
+	if trace != nil && trace.AuthDone != nil {
+		trace.AuthDone(err)
+	}
+}
+
+// TracingDialer is a Dialer running the hooks of Trace at the phases of each
+// dial of Dialer. The trace is passed to Dialer in the context, so Dialer
+// should implement ContextDialer to report the phases between DialStart and
+// DialDone.
+type TracingDialer struct {
+	Dialer
+	Trace *DialTrace
+}
+
+func (d *TracingDialer) Dial(network string, addr string) (c Conn, err error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *TracingDialer) DialContext(ctx context.Context, network string, addr string) (c Conn, err error) {
+	trace := d.Trace
+	if trace == nil {
+		trace = &DialTrace{}
+	}
+	if trace.DialStart != nil {
+		trace.DialStart(network, addr)
+	}
+	ctx = WithDialTrace(ctx, trace)
+	if contextDialer, ok := d.Dialer.(ContextDialer); ok {
+		c, err = contextDialer.DialContext(ctx, network, addr)
+	} else {
+		c, err = DialContext(ctx, network, addr, d.Dialer.Dial)
+	}
+	if trace.DialDone != nil {
+		trace.DialDone(c, err)
+	}
+	return c, err
+}
+
+// Capabilities reports the capabilities of Dialer, which is dialed with a
+// context.
+func (d *TracingDialer) Capabilities() Capabilities {
+	return DialerCapabilities(d.Dialer) | CapabilityContext
+}
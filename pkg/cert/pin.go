@@ -0,0 +1,74 @@
+package cert
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrPinMismatch = errors.New("certificate does not match any pinned SHA-256")
+
+// ParseSha256Pins parses a comma-separated list of hex-encoded SHA-256 pins
+// of the leaf certificate. Colons between bytes are allowed.
+func ParseSha256Pins(s string) (pins [][sha256.Size]byte, err error) {
+	for _, field := range strings.Split(s, ",") {
+		field = strings.ReplaceAll(strings.TrimSpace(field), ":", "")
+		if field == "" {
+			continue
+		}
+		b, err := hex.DecodeString(field)
+		if err != nil {
+			return nil, fmt.Errorf("parse pin %v: %w", field, err)
+		}
+		if len(b) != sha256.Size {
+			return nil, fmt.Errorf("parse pin %v: bad length %v", field, len(b))
+		}
+		var pin [sha256.Size]byte
+		copy(pin[:], b)
+		pins = append(pins, pin)
+	}
+	if len(pins) == 0 {
+		return nil, fmt.Errorf("no pin given")
+	}
+	return pins, nil
+}
+
+// VerifySha256Pins reports an error if the leaf certificate matches none of
+// the pins. It is suitable for tls.Config.VerifyPeerCertificate.
+func VerifySha256Pins(pins [][sha256.Size]byte, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("%w: no certificate", ErrPinMismatch)
+	}
+	sum := sha256.Sum256(rawCerts[0])
+	for _, pin := range pins {
+		if pin == sum {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: got %v", ErrPinMismatch, hex.EncodeToString(sum[:]))
+}
+
+// WithSha256Pins returns a copy of config that additionally requires the leaf
+// certificate to match one of the pins, so that servers rotating between
+// several certificates can be pinned. Verification configured before is kept.
+func WithSha256Pins(config *tls.Config, pins [][sha256.Size]byte) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	verify := config.VerifyPeerCertificate
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if verify != nil {
+			if err := verify(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		return VerifySha256Pins(pins, rawCerts)
+	}
+	return config
+}
@@ -0,0 +1,106 @@
+package cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func newSelfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func handshake(t *testing.T, serverCert tls.Certificate, clientConfig *tls.Config) error {
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		s, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		_ = s.(*tls.Conn).Handshake()
+	}()
+	c, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return tls.Client(c, clientConfig).Handshake()
+}
+
+func TestSha256PinsRotation(t *testing.T) {
+	oldCert := newSelfSignedCert(t)
+	newCert := newSelfSignedCert(t)
+	oldSum := sha256.Sum256(oldCert.Certificate[0])
+	newSum := sha256.Sum256(newCert.Certificate[0])
+	pins, err := ParseSha256Pins(hex.EncodeToString(oldSum[:]) + "," + hex.EncodeToString(newSum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := WithSha256Pins(&tls.Config{ServerName: "example.com", InsecureSkipVerify: true}, pins)
+	if err = handshake(t, newCert, config); err != nil {
+		t.Fatal(err)
+	}
+
+	otherPins, err := ParseSha256Pins(hex.EncodeToString(oldSum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = WithSha256Pins(&tls.Config{ServerName: "example.com", InsecureSkipVerify: true}, otherPins)
+	if err = handshake(t, newCert, config); !errors.Is(err, ErrPinMismatch) {
+		t.Fatal("expected pin mismatch, got", err)
+	}
+}
+
+func TestParseSha256Pins(t *testing.T) {
+	if _, err := ParseSha256Pins("abcd"); err == nil {
+		t.Fatal("short pin should fail")
+	}
+	if _, err := ParseSha256Pins(" , "); err == nil {
+		t.Fatal("empty pins should fail")
+	}
+	sum := sha256.Sum256([]byte("x"))
+	colon := ""
+	for i, b := range sum {
+		if i > 0 {
+			colon += ":"
+		}
+		colon += hex.EncodeToString([]byte{b})
+	}
+	pins, err := ParseSha256Pins(colon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pins[0] != sum {
+		t.Fatal("pin mismatch")
+	}
+}
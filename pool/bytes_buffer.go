@@ -3,15 +3,41 @@ package pool
 import (
 	"bytes"
 	"sync"
+	"sync/atomic"
 )
 
-var bufferPool = sync.Pool{New: func() any { return &bytes.Buffer{} }}
+// bufferPool holds a *sync.Pool, which Drain replaces.
+var bufferPool atomic.Value
+
+func init() {
+	bufferPool.Store(newBufferPool())
+}
+
+func newBufferPool() *sync.Pool {
+	return &sync.Pool{New: func() any { return &bytes.Buffer{} }}
+}
 
 func GetBuffer() *bytes.Buffer {
-	return bufferPool.Get().(*bytes.Buffer)
+	return bufferPool.Load().(*sync.Pool).Get().(*bytes.Buffer)
+}
+
+// GetBufferN gets a buffer with a capacity of at least n. A buffer larger than
+// the largest bucket is allocated directly.
+func GetBufferN(n int) *bytes.Buffer {
+	if n > maxsize {
+		return bytes.NewBuffer(make([]byte, 0, n))
+	}
+	buf := GetBuffer()
+	buf.Grow(n)
+	return buf
 }
 
+// PutBuffer puts a buffer into pool. Buffers grown larger than the largest
+// bucket are left to the GC.
 func PutBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxsize {
+		return
+	}
 	buf.Reset()
-	bufferPool.Put(buf)
+	bufferPool.Load().(*sync.Pool).Put(buf)
 }
@@ -5,6 +5,7 @@ package pool
 import (
 	"math/bits"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -15,17 +16,38 @@ const (
 	minsize      = 1 << minsizePower
 )
 
-var (
-	pools [num]sync.Pool
-)
+type bytePools [num]sync.Pool
+
+// pools holds a *bytePools, which Drain replaces.
+var pools atomic.Value
 
 func init() {
+	pools.Store(newBytePools())
+}
+
+func newBytePools() *bytePools {
+	var p bytePools
 	for i := minsizePower; i < num; i++ {
 		size := 1 << i
-		pools[i].New = func() interface{} {
+		p[i].New = func() interface{} {
 			return make([]byte, size)
 		}
 	}
+	return &p
+}
+
+func getPools() *bytePools {
+	return pools.Load().(*bytePools)
+}
+
+// Drain drops all buffers retained by the pools, e.g. at shutdown or in leak
+// tests. It is best-effort: sync.Pool cannot be cleared, so the pools are
+// replaced with empty ones and the old buffers are freed by the GC. Buffers
+// in use are put into the new pools when they are returned, and a Get or Put
+// racing with Drain may still use the old pools.
+func Drain() {
+	pools.Store(newBytePools())
+	bufferPool.Store(newBufferPool())
 }
 
 func GetClosestN(need int) (n int) {
@@ -50,7 +72,7 @@ func Get(size int) PB {
 		if i < minsizePower {
 			i = minsizePower
 		}
-		return pools[i].Get().([]byte)[:size]
+		return getPools()[i].Get().([]byte)[:size]
 	}
 	return make([]byte, size)
 }
@@ -62,12 +84,13 @@ func GetFullCap(size int) PB {
 }
 
 func GetMustBigger(size int) PB {
-	if size >= 1 && size <= maxsize {
+	// The bigger bucket of maxsize does not exist.
+	if size >= 1 && size < maxsize {
 		i := GetBiggerClosestN(size)
 		if i < minsizePower {
 			i = minsizePower
 		}
-		return pools[i].Get().([]byte)[:size]
+		return getPools()[i].Get().([]byte)[:size]
 	}
 	return make([]byte, size)
 }
@@ -81,12 +104,13 @@ func GetZero(size int) []byte {
 	return b
 }
 
-// Put puts a buffer into pool.
+// Put puts a buffer into pool. Buffers not of a bucket size, such as those
+// made for oversize requests, are left to the GC so that a later Get from the
+// bucket does not get a buffer smaller than the bucket.
 func Put(buf []byte) {
-	if size := cap(buf); size >= 1 && size <= maxsize {
-		i := GetClosestN(size)
-		if i < num {
-			pools[i].Put(buf)
-		}
+	size := cap(buf)
+	if size < minsize || size > maxsize || size&(size-1) != 0 {
+		return
 	}
+	getPools()[GetClosestN(size)].Put(buf)
 }
@@ -0,0 +1,86 @@
+package pool
+
+import (
+	"testing"
+)
+
+func TestDrain(t *testing.T) {
+	buf := Get(1024)
+	buf[0] = 0xff
+	Put(buf)
+	b := GetBuffer()
+	b.WriteString("retained")
+	PutBuffer(b)
+
+	Drain()
+
+	for i := 0; i < 8; i++ {
+		got := Get(1024)
+		if &got[0] == &buf[0] {
+			t.Fatal("a retained buffer survives Drain")
+		}
+		if len(got) != 1024 || cap(got) != 1024 {
+			t.Fatal("unexpected buffer", len(got), cap(got))
+		}
+		defer Put(got)
+	}
+	if got := GetBuffer(); got == b {
+		t.Fatal("a retained bytes.Buffer survives Drain")
+	} else {
+		PutBuffer(got)
+	}
+	// The pools work after Drain.
+	for _, size := range []int{1, 64, 1500, 65536} {
+		got := Get(size)
+		if len(got) != size {
+			t.Fatal("bad length", len(got), "want", size)
+		}
+		Put(got)
+	}
+}
+
+func TestOversize(t *testing.T) {
+	const size = maxsize + 1
+	buf := Get(size)
+	if len(buf) != size {
+		t.Fatal("bad length", len(buf))
+	}
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	Put(buf)
+	if got := GetMustBigger(maxsize); len(got) != maxsize {
+		t.Fatal("bad length", len(got))
+	}
+
+	// A buffer not of a bucket size is not pooled.
+	odd := make([]byte, 1500)
+	Put(odd)
+	for i := 0; i < 8; i++ {
+		got := Get(2048)
+		if &got[:1][0] == &odd[:1][0] || cap(got) != 2048 {
+			t.Fatal("an odd-sized buffer is pooled", cap(got))
+		}
+		defer Put(got)
+	}
+
+	b := GetBufferN(size)
+	if b.Cap() < size || b.Len() != 0 {
+		t.Fatal("unexpected buffer", b.Len(), b.Cap())
+	}
+	b.Write(buf)
+	if b.Len() != size || b.Bytes()[size-1] != buf[size-1] {
+		t.Fatal("bad content")
+	}
+	PutBuffer(b)
+	for i := 0; i < 8; i++ {
+		got := GetBuffer()
+		if got == b || got.Cap() > maxsize {
+			t.Fatal("an oversize bytes.Buffer is pooled", got.Cap())
+		}
+		defer PutBuffer(got)
+	}
+	if got := GetBufferN(100); got.Cap() < 100 {
+		t.Fatal("bad capacity", got.Cap())
+	}
+}
@@ -0,0 +1,56 @@
+package direct
+
+import (
+	"context"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/protocol"
+)
+
+// BypassDialer dials targets matched by the matcher with the direct dialer,
+// and the others with the proxy dialer. It can be used for split-tunnel.
+type BypassDialer struct {
+	proxyDialer  netproxy.Dialer
+	directDialer netproxy.Dialer
+	matcher      *protocol.TargetMatcher
+}
+
+func NewBypassDialer(proxyDialer netproxy.Dialer, directDialer netproxy.Dialer, matcher *protocol.TargetMatcher) *BypassDialer {
+	return &BypassDialer{
+		proxyDialer:  proxyDialer,
+		directDialer: directDialer,
+		matcher:      matcher,
+	}
+}
+
+func (d *BypassDialer) route(addr string) (netproxy.Dialer, error) {
+	bypass, err := d.matcher.MatchString(addr)
+	if err != nil {
+		return nil, err
+	}
+	if bypass {
+		return d.directDialer, nil
+	}
+	return d.proxyDialer, nil
+}
+
+func (d *BypassDialer) Dial(network string, addr string) (c netproxy.Conn, err error) {
+	dialer, err := d.route(addr)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.Dial(network, addr)
+}
+
+func (d *BypassDialer) DialContext(ctx context.Context, network, addr string) (c netproxy.Conn, err error) {
+	dialer, err := d.route(addr)
+	if err != nil {
+		return nil, err
+	}
+	if contextDialer, ok := dialer.(netproxy.ContextDialer); ok {
+		return contextDialer.DialContext(ctx, network, addr)
+	}
+	return netproxy.DialContext(ctx, network, addr, dialer.Dial)
+}
+
+var _ netproxy.ContextDialer = (*BypassDialer)(nil)
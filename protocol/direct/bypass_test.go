@@ -0,0 +1,92 @@
+package direct
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/protocol"
+)
+
+var errProxied = errors.New("proxied")
+
+type recordDialer struct {
+	dialed []string
+}
+
+func (d *recordDialer) Dial(network string, addr string) (c netproxy.Conn, err error) {
+	d.dialed = append(d.dialed, network+" "+addr)
+	return nil, errProxied
+}
+
+func TestBypassDialer(t *testing.T) {
+	matcher, err := protocol.NewTargetMatcher([]string{"127.0.0.0/8", "::1", "lan.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &recordDialer{}
+	direct := &recordDialer{}
+	d := NewBypassDialer(proxy, direct, matcher)
+	tt := []struct {
+		addr   string
+		bypass bool
+	}{
+		{"127.0.0.1:80", true},
+		{"[::1]:53", true},
+		{"lan.example:443", true},
+		{"nas.lan.example:443", true},
+		{"1.1.1.1:53", false},
+		{"[2001:db8::1]:53", false},
+		{"notlan.example:443", false},
+	}
+	for _, test := range tt {
+		for _, network := range []string{"tcp", "udp"} {
+			proxy.dialed, direct.dialed = nil, nil
+			_, _ = d.Dial(network, test.addr)
+			if test.bypass != (len(direct.dialed) == 1) || test.bypass == (len(proxy.dialed) == 1) {
+				t.Fatal(network, test.addr, "direct:", direct.dialed, "proxy:", proxy.dialed)
+			}
+		}
+	}
+}
+
+func TestBypassDialerDirectUdp(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	matcher, err := protocol.NewTargetMatcher([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewBypassDialer(&recordDialer{}, SymmetricDirect, matcher)
+	c, err := d.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	pc, ok := c.(netproxy.PacketConn)
+	if !ok {
+		t.Fatal("not a PacketConn")
+	}
+	if _, err = pc.WriteTo([]byte("ping"), server.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, from, err := server.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.WriteToUDP(buf[:n], from); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err = pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Fatal(string(buf[:n]))
+	}
+}
@@ -41,19 +41,32 @@ func newDirectDialer(fullCone bool) netproxy.Dialer {
 	}
 }
 
-func (d *directDialer) dialUdp(addr string, mark int) (c netproxy.PacketConn, err error) {
+// udpDialArgs returns the network and the local address to dial addr with.
+// An IPv4-mapped addr of udp6, which Go cannot dial, is dialed from a
+// dual-stack IPv6 socket.
+func (d *directDialer) udpDialArgs(network string, addr string) (string, *net.UDPAddr) {
+	if network == "udp6" && d.udpLocalAddr == nil {
+		if addrPort, err := netip.ParseAddrPort(addr); err == nil && addrPort.Addr().Is4In6() {
+			return "udp", &net.UDPAddr{IP: net.IPv6unspecified}
+		}
+	}
+	return network, d.udpLocalAddr
+}
+
+func (d *directDialer) dialUdp(network string, addr string, mark int) (c netproxy.PacketConn, err error) {
+	network, localAddr := d.udpDialArgs(network, addr)
 	if mark == 0 {
 		if d.fullCone {
-			conn, err := net.ListenUDP("udp", d.udpLocalAddr)
+			conn, err := net.ListenUDP(network, localAddr)
 			if err != nil {
 				return nil, err
 			}
 			return &directPacketConn{UDPConn: conn, FullCone: true, dialTgt: addr}, nil
 		} else {
 			dialer := net.Dialer{
-				LocalAddr: d.udpLocalAddr,
+				LocalAddr: localAddr,
 			}
-			conn, err := dialer.Dial("udp", addr)
+			conn, err := dialer.Dial(network, addr)
 			if err != nil {
 				return nil, err
 			}
@@ -63,7 +76,7 @@ func (d *directDialer) dialUdp(addr string, mark int) (c netproxy.PacketConn, er
 	} else {
 		var conn *net.UDPConn
 		if d.fullCone {
-			conn, err = net.ListenUDP("udp", d.udpLocalAddr)
+			conn, err = net.ListenUDP(network, localAddr)
 			if err != nil {
 				return nil, err
 			}
@@ -72,9 +85,9 @@ func (d *directDialer) dialUdp(addr string, mark int) (c netproxy.PacketConn, er
 				Control: func(network, address string, c syscall.RawConn) error {
 					return netproxy.SoMarkControl(c, mark)
 				},
-				LocalAddr: d.udpLocalAddr,
+				LocalAddr: localAddr,
 			}
-			c, err := dialer.Dial("udp", addr)
+			c, err := dialer.Dial(network, addr)
 			if err != nil {
 				return nil, err
 			}
@@ -136,8 +149,8 @@ func (d *directDialer) Dial(network, addr string) (c netproxy.Conn, err error) {
 	switch magicNetwork.Network {
 	case "tcp":
 		return d.dialTcp(addr, int(magicNetwork.Mark))
-	case "udp":
-		return d.dialUdp(addr, int(magicNetwork.Mark))
+	case "udp", "udp4", "udp6":
+		return d.dialUdp(magicNetwork.Network, addr, int(magicNetwork.Mark))
 	default:
 		return nil, fmt.Errorf("%w: %v", netproxy.UnsupportedTunnelTypeError, network)
 	}
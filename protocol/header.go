@@ -1,6 +1,9 @@
 package protocol
 
-import "crypto/tls"
+import (
+	"crypto/tls"
+	"net/url"
+)
 
 type Header struct {
 	ProxyAddress string
@@ -12,6 +15,9 @@ type Header struct {
 	Password     string
 	IsClient     bool
 	Flags        Flags
+	// Params are extra protocol-specific dial parameters, typically the query
+	// of the proxy link.
+	Params url.Values
 }
 
 type Flags uint64
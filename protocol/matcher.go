@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// TargetMatcher matches targets against a set of CIDR and domain rules.
+// A domain rule matches the domain itself and all of its subdomains.
+type TargetMatcher struct {
+	// prefixes is sorted from the longest prefix to the shortest and domains
+	// from the longest domain to the shortest, so that the first match is the
+	// most specific rule.
+	prefixes []prefixRule
+	domains  []domainRule
+}
+
+type prefixRule struct {
+	prefix netip.Prefix
+	rule   int
+}
+
+type domainRule struct {
+	domain string
+	rule   int
+}
+
+// NewTargetMatcher parses rules such as "10.0.0.0/8", "192.168.1.1" and
+// "example.com".
+func NewTargetMatcher(rules []string) (*TargetMatcher, error) {
+	m := &TargetMatcher{}
+	for i, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		if strings.Contains(rule, "/") {
+			prefix, err := netip.ParsePrefix(rule)
+			if err != nil {
+				return nil, fmt.Errorf("parse rule %v: %w", rule, err)
+			}
+			m.prefixes = append(m.prefixes, prefixRule{prefix: prefix.Masked(), rule: i})
+			continue
+		}
+		ip, err := netip.ParseAddr(rule)
+		if err == nil {
+			ip = ip.Unmap()
+			m.prefixes = append(m.prefixes, prefixRule{prefix: netip.PrefixFrom(ip, ip.BitLen()), rule: i})
+			continue
+		}
+		if strings.Contains(rule, ":") {
+			// Neither an IPv6 address nor a domain; probably with a port.
+			return nil, fmt.Errorf("parse rule %v: %w", rule, err)
+		}
+		m.domains = append(m.domains, domainRule{domain: strings.ToLower(strings.TrimSuffix(rule, ".")), rule: i})
+	}
+	sort.SliceStable(m.prefixes, func(i, j int) bool {
+		return m.prefixes[i].prefix.Bits() > m.prefixes[j].prefix.Bits()
+	})
+	sort.SliceStable(m.domains, func(i, j int) bool {
+		return len(m.domains[i].domain) > len(m.domains[j].domain)
+	})
+	return m, nil
+}
+
+func (m *TargetMatcher) Match(mdata *Metadata) bool {
+	switch mdata.Type {
+	case MetadataTypeIPv4, MetadataTypeIPv6:
+		ip, err := netip.ParseAddr(mdata.Hostname)
+		if err != nil {
+			return false
+		}
+		_, ok := m.MatchAddr(ip)
+		return ok
+	case MetadataTypeDomain:
+		_, ok := m.MatchDomain(mdata.Hostname)
+		return ok
+	}
+	return false
+}
+
+// MatchAddr returns the index of the most specific rule that matches ip among
+// the rules given to NewTargetMatcher. ok is false if none matches.
+func (m *TargetMatcher) MatchAddr(ip netip.Addr) (rule int, ok bool) {
+	ip = ip.Unmap()
+	for _, p := range m.prefixes {
+		if p.prefix.Contains(ip) {
+			return p.rule, true
+		}
+	}
+	return 0, false
+}
+
+// MatchDomain is like MatchAddr but matches the domain host.
+func (m *TargetMatcher) MatchDomain(host string) (rule int, ok bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range m.domains {
+		if host == d.domain || strings.HasSuffix(host, "."+d.domain) {
+			return d.rule, true
+		}
+	}
+	return 0, false
+}
+
+// MatchString parses the target and matches it.
+func (m *TargetMatcher) MatchString(target string) (bool, error) {
+	mdata, err := ParseMetadata(target)
+	if err != nil {
+		return false, err
+	}
+	return m.Match(&mdata), nil
+}
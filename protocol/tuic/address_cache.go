@@ -0,0 +1,65 @@
+package tuic
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/daeuniverse/softwind/protocol"
+)
+
+const addressCacheSize = 16
+
+// addressCache is a small LRU of parsed Addresses keyed by the target string.
+// Cached Addresses are shared and must not be modified.
+type addressCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type addressCacheEntry struct {
+	key     string
+	address *Address
+}
+
+func newAddressCache(size int) *addressCache {
+	return &addressCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element, size),
+	}
+}
+
+// Get returns the Address of addr, parsing and caching it on miss.
+func (c *addressCache) Get(addr string) (*Address, error) {
+	c.mu.Lock()
+	if e, ok := c.items[addr]; ok {
+		c.ll.MoveToFront(e)
+		address := e.Value.(*addressCacheEntry).address
+		c.mu.Unlock()
+		return address, nil
+	}
+	c.mu.Unlock()
+
+	mdata, err := protocol.ParseMetadata(addr)
+	if err != nil {
+		return nil, err
+	}
+	address := NewAddress(&mdata)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[addr]; ok {
+		// Added concurrently.
+		c.ll.MoveToFront(e)
+		return e.Value.(*addressCacheEntry).address, nil
+	}
+	c.items[addr] = c.ll.PushFront(&addressCacheEntry{key: addr, address: address})
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*addressCacheEntry).key)
+	}
+	return address, nil
+}
@@ -0,0 +1,90 @@
+package tuic
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/daeuniverse/softwind/protocol"
+)
+
+func TestAddressCacheEncoding(t *testing.T) {
+	cache := newAddressCache(2)
+	for _, addr := range []string{"1.1.1.1:53", "[2001:db8::1]:443", "example.com:80"} {
+		mdata, err := protocol.ParseMetadata(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := new(bytes.Buffer)
+		if err = NewAddress(&mdata).WriteTo(expected); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			address, err := cache.Get(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := new(bytes.Buffer)
+			if err = address.WriteTo(got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), expected.Bytes()) {
+				t.Fatal(addr, i, got.Bytes(), "!=", expected.Bytes())
+			}
+		}
+	}
+	if cache.ll.Len() != 2 {
+		t.Fatal("cache is not bounded:", cache.ll.Len())
+	}
+	if _, ok := cache.items["1.1.1.1:53"]; ok {
+		t.Fatal("the least recently used entry is not evicted")
+	}
+	if _, err := cache.Get("bad"); err == nil {
+		t.Fatal("expected parse error")
+	}
+}
+
+func TestAddressCacheConcurrent(t *testing.T) {
+	cache := newAddressCache(4)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := cache.Get("10.0.0." + strconv.Itoa((i+j)%8) + ":53"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if cache.ll.Len() != len(cache.items) || cache.ll.Len() > 4 {
+		t.Fatal("inconsistent cache", cache.ll.Len(), len(cache.items))
+	}
+}
+
+var benchmarkTargets = []string{"8.8.8.8:53", "[2606:4700:4700::1111]:443", "stun.example.com:3478"}
+
+func BenchmarkAddressParse(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		mdata, err := protocol.ParseMetadata(benchmarkTargets[i%len(benchmarkTargets)])
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = NewAddress(&mdata)
+	}
+}
+
+func BenchmarkAddressCache(b *testing.B) {
+	cache := newAddressCache(addressCacheSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := cache.Get(benchmarkTargets[i%len(benchmarkTargets)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package tuic
+
+import (
+	"bytes"
+
+	"github.com/daeuniverse/softwind/pool"
+)
+
+// Allocator allocates the buffers a packet conn encodes commands into.
+type Allocator interface {
+	// Get returns a buffer of length n.
+	Get(n int) []byte
+	// Put releases a buffer returned by Get, which is not used afterwards.
+	Put(b []byte)
+}
+
+// DefaultAllocator allocates from package pool.
+var DefaultAllocator Allocator = poolAllocator{}
+
+type poolAllocator struct{}
+
+func (poolAllocator) Get(n int) []byte {
+	return pool.Get(n)
+}
+
+func (poolAllocator) Put(b []byte) {
+	pool.Put(b)
+}
+
+// allocatorHolder wraps an Allocator for atomic.Value, which needs a consistent
+// concrete type.
+type allocatorHolder struct {
+	Allocator
+}
+
+// SetAllocator makes the packet conn allocate its buffers with allocator
+// instead of DefaultAllocator. nil restores DefaultAllocator. Incoming packets
+// are copied into the buffers given to ReadFrom, so it only affects writes.
+func (q *quicStreamPacketConn) SetAllocator(allocator Allocator) {
+	if allocator == nil {
+		allocator = DefaultAllocator
+	}
+	q.alloc.Store(allocatorHolder{allocator})
+}
+
+func (q *quicStreamPacketConn) allocator() Allocator {
+	if holder, ok := q.alloc.Load().(allocatorHolder); ok {
+		return holder.Allocator
+	}
+	return DefaultAllocator
+}
+
+// getBuffer returns a buffer of the allocator with room for n bytes, and the
+// function to release it. The buffer grows out of the allocator if more is
+// written.
+func (q *quicStreamPacketConn) getBuffer(n int) (*bytes.Buffer, func()) {
+	allocator := q.allocator()
+	b := allocator.Get(n)
+	return bytes.NewBuffer(b[:0]), func() {
+		allocator.Put(b)
+	}
+}
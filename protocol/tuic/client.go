@@ -1,12 +1,15 @@
 package tuic
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -22,6 +25,10 @@ import (
 
 const Ver5 = 0x5
 
+// closeGracePeriod is how long a failed client keeps its connection before
+// closing it.
+var closeGracePeriod = 10 * time.Second
+
 type ClientOption struct {
 	TlsConfig             *tls.Config
 	QuicConfig            *quic.Config
@@ -30,20 +37,82 @@ type ClientOption struct {
 	UdpRelayMode          common.UdpRelayMode
 	MaxUdpRelayPacketSize int
 	CongestionController  string
-	ReduceRtt             bool
-	CWND                  int
+	// MtuOverrides lowers MaxUdpRelayPacketSize for some targets. It may be
+	// nil.
+	MtuOverrides *mtuOverrides
+	// HandshakeCongestion replaces CongestionController until the handshake
+	// of an early connection completes if it is not empty.
+	HandshakeCongestion string
+	ReduceRtt           bool
+	CWND                int
+	// SequentialPktId makes packet conns allocate PKT_ID from a per-conn
+	// counter instead of picking a random one for each packet.
+	SequentialPktId bool
+	// PadMultiple pads each UDP relay datagram up to a multiple of it to hide
+	// the sizes of small packets such as DNS. 0 disables padding.
+	PadMultiple int
+	// PacketCodec frames UDP relay packets. DefaultPacketCodec is used if nil.
+	PacketCodec PacketCodec
+	// MaxTargetStreams makes packet conns in QUIC relay mode keep up to this
+	// many uni-streams, one per target, instead of opening a stream per packet.
+	// The server must read multiple packets from a stream. 0 disables it.
+	MaxTargetStreams int
+	// InboundPacketsPerSec and InboundBytesPerSec limit packets received by
+	// the client. Excess packets are dropped and counted. 0 means no limit.
+	InboundPacketsPerSec int
+	InboundBytesPerSec   int
+	// OnFragmentDrop is called when fragments of an incoming packet are dropped
+	// before reassembly, which indicates loss or an attack. It may be nil.
+	OnFragmentDrop func(connId uint16, pktId uint16, fragments int, reason FragmentDropReason)
+	// ReorderWindow is DeFragger.ReorderWindow of each packet conn.
+	ReorderWindow int
+	// DefaultWriteTimeout bounds each write of packet conns without a write
+	// deadline. 0 disables it.
+	DefaultWriteTimeout time.Duration
+	// MaxConnLifetime makes the client replace its connection once it is this
+	// old. 0 disables it.
+	MaxConnLifetime time.Duration
+	// GreaseAlpn adds a GREASE ALPN value to TlsConfig, drawn anew for each
+	// connection so that the value does not identify the client.
+	GreaseAlpn bool
+	// HeartbeatJitter randomizes the KeepAlivePeriod of QuicConfig for each
+	// connection by up to this percentage in either direction.
+	HeartbeatJitter int
 }
 
 type clientImpl struct {
+	// inboundDropped counts packets dropped by inboundLimiter. Keep it first
+	// for alignment on 32-bit platforms.
+	inboundDropped uint64
+
 	*ClientOption
 	udp bool
 
-	quicConn  quic.Connection
+	inboundLimiterOnce sync.Once
+	inboundLimiter     *inboundLimiter
+
+	quicConn quic.Connection
+	// socket is the UDP conn quicConn runs on.
+	socket    net.PacketConn
 	connMutex sync.Mutex
+	// rotateTimer rotates quicConn after MaxConnLifetime. It may be nil.
+	rotateTimer *time.Timer
+
+	// streams counts open TCP streams on each connection, so that a
+	// connection retired by rotation is closed once they are all closed.
+	muStreams sync.Mutex
+	streams   map[quic.Connection]int
+	retired   map[quic.Connection]struct{}
 
 	closed bool
+	// closeErr is the error that closed the client. done is closed once it is set.
+	closeErr error
+	done     chan struct{}
+	doneOnce sync.Once
 
 	udpIncomingPacketsMap sync.Map
+	// udpSessions maps connId to *quicStreamPacketConn.
+	udpSessions sync.Map
 
 	// only ready for PoolClient
 	lastVisited atomic.Value
@@ -51,6 +120,36 @@ type clientImpl struct {
 	onClose func()
 }
 
+func (t *clientImpl) packetCodec() PacketCodec {
+	if t.PacketCodec == nil {
+		return DefaultPacketCodec
+	}
+	return t.PacketCodec
+}
+
+func (t *clientImpl) getInboundLimiter() *inboundLimiter {
+	t.inboundLimiterOnce.Do(func() {
+		t.inboundLimiter = newInboundLimiter(t.InboundPacketsPerSec, t.InboundBytesPerSec)
+	})
+	return t.inboundLimiter
+}
+
+// allowInbound reports whether an incoming packet of n bytes is within the
+// inbound limits, and counts it as dropped otherwise.
+func (t *clientImpl) allowInbound(n int) bool {
+	if t.getInboundLimiter().Allow(n, time.Now()) {
+		return true
+	}
+	atomic.AddUint64(&t.inboundDropped, 1)
+	return false
+}
+
+// InboundDropped returns the number of incoming packets dropped for exceeding
+// the inbound limits.
+func (t *clientImpl) InboundDropped() uint64 {
+	return atomic.LoadUint64(&t.inboundDropped)
+}
+
 func (t *clientImpl) LastVisited() time.Time {
 	return t.lastVisited.Load().(time.Time)
 }
@@ -59,31 +158,119 @@ func (t *clientImpl) SetLastVisited(last time.Time) {
 	t.lastVisited.Store(last)
 }
 
+// getQuicConn returns the connection of the client, establishing it on first
+// use. Concurrent callers wait for the handshake in progress and share its
+// connection rather than starting their own. ctx bounds the dial of the UDP
+// conn, the QUIC handshake and, unless ReduceRtt is set, the authentication;
+// if it is done before the connection is authenticated, the connection is
+// closed and ctx.Err() is returned.
 func (t *clientImpl) getQuicConn(ctx context.Context, dialer netproxy.Dialer, dialFn common.DialFunc) (quic.Connection, error) {
 	t.connMutex.Lock()
 	defer t.connMutex.Unlock()
 	if t.quicConn != nil {
 		return t.quicConn, nil
 	}
-	transport, addr, err := dialFn(ctx, dialer)
+	quicConn, socket, err := t.dialQuicConn(ctx, dialer, dialFn)
 	if err != nil {
 		return nil, err
 	}
+	t.setQuicConn(quicConn, socket, dialer, dialFn)
+	return quicConn, nil
+}
+
+// setQuicConn makes quicConn the connection of the client. connMutex must be
+// held.
+func (t *clientImpl) setQuicConn(quicConn quic.Connection, socket net.PacketConn, dialer netproxy.Dialer, dialFn common.DialFunc) {
+	t.quicConn = quicConn
+	t.socket = socket
+	if t.MaxConnLifetime > 0 {
+		t.rotateTimer = lifetimeAfterFunc(t.MaxConnLifetime, func() {
+			t.rotate(quicConn, dialer, dialFn)
+		})
+	}
+}
+
+// tlsConfig returns the TLS config of a new connection.
+func (t *clientImpl) tlsConfig() *tls.Config {
+	if t.GreaseAlpn {
+		return common.WithGreaseAlpn(t.TlsConfig)
+	}
+	return t.TlsConfig
+}
+
+// quicConfig returns the QUIC config of a new connection.
+func (t *clientImpl) quicConfig() *quic.Config {
+	if t.HeartbeatJitter > 0 {
+		quicConfig := t.QuicConfig.Clone()
+		quicConfig.KeepAlivePeriod = jitterDuration(quicConfig.KeepAlivePeriod, t.HeartbeatJitter)
+		return quicConfig
+	}
+	return t.QuicConfig
+}
+
+// dialQuicConn dials and authenticates a connection as getQuicConn describes,
+// and returns it with the UDP conn it runs on.
+func (t *clientImpl) dialQuicConn(ctx context.Context, dialer netproxy.Dialer, dialFn common.DialFunc) (quic.Connection, net.PacketConn, error) {
+	trace := netproxy.ContextDialTrace(ctx)
+	transport, addr, err := dialFn(netproxy.WithDialTrace(ctx, nil), dialer)
+	netproxy.TraceConnectDone(trace, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := t.tlsConfig()
+	quicConfig := t.quicConfig()
 	var quicConn quic.Connection
 	if t.ReduceRtt {
-		quicConn, err = transport.DialEarly(ctx, addr, t.TlsConfig, t.QuicConfig)
+		quicConn, err = transport.DialEarly(ctx, addr, tlsConfig, quicConfig)
 	} else {
-		quicConn, err = transport.Dial(ctx, addr, t.TlsConfig, t.QuicConfig)
+		quicConn, err = transport.Dial(ctx, addr, tlsConfig, quicConfig)
+	}
+	if err != nil || !t.ReduceRtt {
+		// DialEarly returns before the handshake is complete.
+		netproxy.TraceHandshakeDone(trace, err)
 	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	common.SetCongestionController(quicConn, t.CongestionController, t.CWND)
+	if early, ok := quicConn.(quic.EarlyConnection); ok && t.ReduceRtt && t.HandshakeCongestion != "" {
+		common.SetHandshakeCongestionController(early, t.HandshakeCongestion, t.CongestionController, t.CWND)
+	} else {
+		// Dial returns once the handshake is complete.
+		common.SetCongestionController(quicConn, t.CongestionController, t.CWND)
+	}
 
-	go func() {
-		_ = t.sendAuthentication(quicConn)
-	}()
+	if t.ReduceRtt {
+		// Data goes ahead of the authentication, which is not waited for.
+		go func() {
+			if early, ok := quicConn.(quic.EarlyConnection); ok && trace != nil {
+				select {
+				case <-early.HandshakeComplete():
+					netproxy.TraceHandshakeDone(trace, nil)
+				case <-quicConn.Context().Done():
+					netproxy.TraceHandshakeDone(trace, context.Cause(quicConn.Context()))
+				}
+			}
+			err := t.sendAuthentication(quicConn.Context(), quicConn)
+			netproxy.TraceAuthDone(trace, err)
+			t.deferQuicConn(quicConn, err)
+		}()
+	} else {
+		authDone := make(chan error, 1)
+		go func() {
+			authDone <- t.sendAuthentication(ctx, quicConn)
+		}()
+		select {
+		case err = <-authDone:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		netproxy.TraceAuthDone(trace, err)
+		if err != nil {
+			_ = quicConn.CloseWithError(ProtocolError, err.Error())
+			return nil, nil, err
+		}
+	}
 
 	if t.udp && t.UdpRelayMode == common.QUIC {
 		go func() {
@@ -94,15 +281,23 @@ func (t *clientImpl) getQuicConn(ctx context.Context, dialer netproxy.Dialer, di
 		_ = t.handleMessage(quicConn) // always handleMessage because tuicV5 using datagram to send the Heartbeat
 	}()
 
-	t.quicConn = quicConn
-	return quicConn, nil
+	return quicConn, transport.Conn, nil
 }
 
-func (t *clientImpl) sendAuthentication(quicConn quic.Connection) (err error) {
-	defer func() {
-		t.deferQuicConn(quicConn, err)
-	}()
-	stream, err := quicConn.OpenUniStream()
+// sendAuthentication authenticates the connection, giving up once ctx is done.
+func (t *clientImpl) sendAuthentication(ctx context.Context, quicConn quic.Connection) (err error) {
+	if early, ok := quicConn.(quic.EarlyConnection); ok {
+		// The token is exported from the TLS session, which is not available
+		// in 0-RTT.
+		select {
+		case <-early.HandshakeComplete():
+		case <-quicConn.Context().Done():
+			return context.Cause(quicConn.Context())
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	stream, err := quicConn.OpenUniStreamSync(ctx)
 	if err != nil {
 		return err
 	}
@@ -148,18 +343,21 @@ func (t *clientImpl) handleUniStream(quicConn quic.Connection) (err error) {
 				}
 				stream.CancelRead(0)
 			}()
-			reader := bufio.NewReader(stream)
-			var commandHead *CommandHead
-			commandHead, err = ReadCommandHead(reader)
-			if err != nil {
-				return err
-			}
-			switch commandHead.TYPE {
-			case PacketType:
+			reader := NewPacketReader(stream, t.packetCodec(), t.MaxUdpRelayPacketSize)
+			// A stream may carry multiple packets of a session.
+			for {
 				var packet *Packet
-				packet, err = ReadPacketWithHead(commandHead, reader)
+				packet, err = reader.ReadPacket()
 				if err != nil {
-					return
+					// Only the stream is bad if it carries something else
+					// or a packet too large.
+					if errors.Is(err, io.EOF) || errors.Is(err, ErrNotPacket) || errors.Is(err, ErrPacketTooLarge) {
+						return nil
+					}
+					return err
+				}
+				if !t.allowInbound(packet.BytesLen()) {
+					continue
 				}
 				if t.udp && t.UdpRelayMode == common.QUIC {
 					assocId = packet.ASSOC_ID
@@ -169,7 +367,6 @@ func (t *clientImpl) handleUniStream(quicConn quic.Connection) (err error) {
 					}
 				}
 			}
-			return nil
 		}(stream)
 	}
 }
@@ -186,6 +383,9 @@ func (t *clientImpl) handleMessage(quicConn quic.Connection) (err error) {
 		if err != nil {
 			return err
 		}
+		if !t.allowInbound(len(message)) {
+			continue
+		}
 		go func(message []byte) (err error) {
 			var assocId uint16
 			defer func() {
@@ -204,7 +404,7 @@ func (t *clientImpl) handleMessage(quicConn quic.Connection) (err error) {
 			switch commandHead.TYPE {
 			case PacketType:
 				var packet *Packet
-				packet, err = ReadPacketWithHead(commandHead, reader)
+				packet, err = t.packetCodec().Decode(commandHead, reader)
 				if err != nil {
 					return err
 				}
@@ -227,9 +427,23 @@ func (t *clientImpl) handleMessage(quicConn quic.Connection) (err error) {
 }
 
 func (t *clientImpl) deferQuicConn(quicConn quic.Connection, err error) {
-	if err != nil && !strings.Contains(err.Error(), common.ErrTooManyOpenStreams.Error()) {
-		t.forceClose(quicConn, err)
+	// A write timing out does not mean the connection is broken.
+	if err == nil || strings.Contains(err.Error(), common.ErrTooManyOpenStreams.Error()) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return
 	}
+	// Neither does a packet dropped for itself, such as a bad target.
+	var dropErr *WriteDropError
+	if errors.As(err, &dropErr) && dropErr.Reason != WriteDropClosed {
+		return
+	}
+	t.connMutex.Lock()
+	rotated := t.quicConn != nil && t.quicConn != quicConn
+	t.connMutex.Unlock()
+	if rotated {
+		// The client has moved on to another connection.
+		return
+	}
+	t.forceClose(quicConn, err)
 }
 
 func (t *clientImpl) forceClose(quicConn quic.Connection, err error) {
@@ -239,18 +453,30 @@ func (t *clientImpl) forceClose(quicConn quic.Connection, err error) {
 		return
 	}
 	t.closed = true
+	if err == nil {
+		err = common.ErrClientClosed
+	}
+	t.closeErr = err
+	close(t.doneChan())
 	if t.onClose != nil {
 		go t.onClose()
 		t.onClose = nil
 	}
+	if t.rotateTimer != nil {
+		t.rotateTimer.Stop()
+	}
+	if quicConn == nil {
+		quicConn = t.quicConn
+	}
 	t.connMutex.Unlock()
-	// Give 10s for closing.
-	time.AfterFunc(10*time.Second, func() {
+	// Dissociate now rather than after the grace period, by when the
+	// connection has likely died of the failure.
+	if quicConn != nil {
+		t.dissociateAll(quicConn)
+	}
+	time.AfterFunc(closeGracePeriod, func() {
 		t.connMutex.Lock()
 		defer t.connMutex.Unlock()
-		if quicConn == nil {
-			quicConn = t.quicConn
-		}
 		if quicConn != nil {
 			if quicConn == t.quicConn {
 				t.quicConn = nil
@@ -271,6 +497,42 @@ func (t *clientImpl) forceClose(quicConn quic.Connection, err error) {
 	})
 }
 
+// dissociateAll sends Dissociate for active UDP sessions on quicConn before it
+// is closed, so that the server releases them without waiting for a timeout.
+// It is best-effort and does nothing if the connection is already gone.
+func (t *clientImpl) dissociateAll(quicConn quic.Connection) {
+	t.udpSessions.Range(func(key, value any) bool {
+		if quicConn.Context().Err() != nil {
+			return false
+		}
+		pc := value.(*quicStreamPacketConn)
+		if pcConn, _ := pc.conn(); pcConn == quicConn {
+			_ = pc.dissociate(quicConn)
+		}
+		return true
+	})
+}
+
+func (t *clientImpl) doneChan() chan struct{} {
+	t.doneOnce.Do(func() {
+		t.done = make(chan struct{})
+	})
+	return t.done
+}
+
+// Done returns a channel that is closed once the client is closed, either by
+// Close or by a background failure of the connection.
+func (t *clientImpl) Done() <-chan struct{} {
+	return t.doneChan()
+}
+
+// Err returns the error that closed the client, or nil if it is alive.
+func (t *clientImpl) Err() error {
+	t.connMutex.Lock()
+	defer t.connMutex.Unlock()
+	return t.closeErr
+}
+
 func (t *clientImpl) Close() error {
 	t.forceClose(nil, common.ErrClientClosed)
 	return nil
@@ -280,7 +542,7 @@ func (t *clientImpl) DialContextWithDialer(ctx context.Context, metadata *protoc
 	if t.closed {
 		return nil, common.ErrClientClosed
 	}
-	quicConn, err := t.getQuicConn(ctx, dialer, dialFn)
+	quicConn, err := t.acquireStream(ctx, dialer, dialFn)
 	if err != nil {
 		return nil, err
 	}
@@ -293,17 +555,21 @@ func (t *clientImpl) DialContextWithDialer(ctx context.Context, metadata *protoc
 		defer buf.Put()
 		n := connect.WriteToBytes(buf)
 		if n != len(buf) {
+			t.releaseStream(quicConn)
 			return nil, fmt.Errorf("n != len(buf)")
 		}
 		quicStream, err := quicConn.OpenStream()
 		if err != nil {
+			t.releaseStream(quicConn)
 			return nil, err
 		}
 		stream = common.NewSafeStreamConn(
 			quicStream,
 			quicConn.LocalAddr(),
 			quicConn.RemoteAddr(),
-			nil,
+			func() {
+				t.releaseStream(quicConn)
+			},
 		)
 		if _, err = stream.Write(buf); err != nil {
 			_ = stream.Close()
@@ -337,17 +603,79 @@ func (t *clientImpl) ListenPacketWithDialer(ctx context.Context, metadata *proto
 		}
 	}
 	pc := &quicStreamPacketConn{
+		target:                net.JoinHostPort(metadata.Hostname, strconv.Itoa(int(metadata.Port))),
 		connId:                connId,
 		quicConn:              quicConn,
 		incomingPackets:       incomingPackets,
 		udpRelayMode:          t.UdpRelayMode,
 		maxUdpRelayPacketSize: t.MaxUdpRelayPacketSize,
+		mtuOverrides:          t.MtuOverrides,
+		sequentialPktId:       t.SequentialPktId,
+		padMultiple:           t.PadMultiple,
+		addressCache:          newAddressCache(addressCacheSize),
+		codec:                 t.PacketCodec,
+		defaultWriteTimeout:   t.DefaultWriteTimeout,
 		deferQuicConnFn:       t.deferQuicConn,
-		closeDeferFn:          nil,
+		closeDeferFn: func() {
+			t.udpSessions.Delete(connId)
+			t.udpIncomingPacketsMap.Delete(connId)
+		},
+		createdAt: time.Now(),
+		client:    t,
+	}
+	t.connMutex.Lock()
+	if socket := t.socket; socket != nil && t.quicConn == quicConn {
+		pc.pathMTU = func() (int, error) {
+			return socketPathMTU(socket, quicConn.RemoteAddr())
+		}
+	}
+	t.connMutex.Unlock()
+	pc.deFragger.ReorderWindow = t.ReorderWindow
+	if onFragmentDrop := t.OnFragmentDrop; onFragmentDrop != nil {
+		pc.deFragger.OnDrop = func(pktId uint16, fragments int, reason FragmentDropReason) {
+			onFragmentDrop(connId, pktId, fragments, reason)
+		}
+	}
+	if t.UdpRelayMode == common.QUIC && t.MaxTargetStreams > 0 {
+		pc.targetStreams = newTargetStreams(t.MaxTargetStreams)
+	}
+	t.udpSessions.Store(connId, pc)
+	// The connection may be rotated before the session is stored.
+	t.connMutex.Lock()
+	current, socket := t.quicConn, t.socket
+	t.connMutex.Unlock()
+	if current != nil && current != quicConn {
+		pc.migrate(quicConn, current, socket)
 	}
 	return pc, nil
 }
 
+// SessionInfo is a snapshot of a UDP session.
+type SessionInfo struct {
+	ConnId  uint16
+	Target  string
+	RxBytes uint64
+	TxBytes uint64
+	Age     time.Duration
+	// RxRate and TxRate are the recent rates in bytes per second.
+	RxRate float64
+	TxRate float64
+	// FragmentsDropped is the number of fragments dropped from reassembly.
+	FragmentsDropped uint64
+}
+
+// Sessions returns a snapshot of active UDP sessions. It is safe to call
+// concurrently with dialing and closing.
+func (t *clientImpl) Sessions() []SessionInfo {
+	var sessions []SessionInfo
+	now := time.Now()
+	t.udpSessions.Range(func(key, value any) bool {
+		sessions = append(sessions, value.(*quicStreamPacketConn).sessionInfo(now))
+		return true
+	})
+	return sessions
+}
+
 func (t *clientImpl) setOnClose(f func()) {
 	t.onClose = f
 }
@@ -70,6 +70,26 @@ func (r *clientRing) ListenPacketWithDialer(ctx context.Context, metadata *proto
 	return conn, err
 }
 
+func (r *clientRing) Sessions() (sessions []SessionInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for elem := r.ring.Front(); elem != nil; elem = elem.Next() {
+		sessions = append(sessions, elem.Value.(*clientRingNode).cli.Sessions()...)
+	}
+	return sessions
+}
+
+// InboundDropped returns the number of incoming packets dropped by the
+// inbound limits of current clients.
+func (r *clientRing) InboundDropped() (dropped uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for elem := r.ring.Front(); elem != nil; elem = elem.Next() {
+		dropped += elem.Value.(*clientRingNode).cli.InboundDropped()
+	}
+	return dropped
+}
+
 func (r *clientRing) _tryNext(current **list.Element, f func(cli *clientRingNode) error) (err error) {
 	var cli *clientRingNode
 	if *current == nil {
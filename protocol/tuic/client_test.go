@@ -0,0 +1,281 @@
+package tuic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/daeuniverse/softwind/protocol/tuic/common"
+	"github.com/mzz2017/quic-go"
+	"github.com/mzz2017/quic-go/congestion"
+)
+
+func newTestClient(quicConn *fakeQuicConn) *clientImpl {
+	return &clientImpl{
+		ClientOption: &ClientOption{
+			UdpRelayMode:          common.NATIVE,
+			MaxUdpRelayPacketSize: 1400,
+		},
+		udp:      true,
+		quicConn: quicConn,
+	}
+}
+
+func listenTestPacket(t *testing.T, cli *clientImpl, target string) *quicStreamPacketConn {
+	mdata, err := protocol.ParseMetadata(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := cli.ListenPacketWithDialer(context.TODO(), &mdata, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+func TestSessions(t *testing.T) {
+	cli := newTestClient(&fakeQuicConn{})
+	targets := []string{"1.1.1.1:53", "[2001:db8::1]:443", "example.com:123"}
+	conns := make(map[string]*quicStreamPacketConn)
+	for i, target := range targets {
+		pc := listenTestPacket(t, cli, target)
+		if _, err := pc.Write(make([]byte, 10*(i+1))); err != nil {
+			t.Fatal(err)
+		}
+		conns[target] = pc
+	}
+	if err := conns["example.com:123"].Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := cli.Sessions()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Target < sessions[j].Target })
+	if len(sessions) != 2 {
+		t.Fatal("unexpected sessions", sessions)
+	}
+	for i, target := range targets[:2] {
+		s := sessions[i]
+		if s.Target != target || s.ConnId != conns[target].connId || s.TxBytes != uint64(10*(i+1)) || s.Age <= 0 {
+			t.Fatal("unexpected session", s)
+		}
+	}
+	if _, ok := cli.udpIncomingPacketsMap.Load(conns["example.com:123"].connId); ok {
+		t.Fatal("closed session is still registered")
+	}
+}
+
+func TestClientErr(t *testing.T) {
+	quicConn := &fakeQuicConn{}
+	cli := newTestClient(quicConn)
+	pc := listenTestPacket(t, cli, "1.1.1.1:53")
+	if cli.Err() != nil || pc.Err() != nil {
+		t.Fatal("alive client reports an error")
+	}
+	// Simulate a failure of a background loop.
+	bgErr := errors.New("receive message: timeout")
+	cli.deferQuicConn(quicConn, bgErr)
+	select {
+	case <-pc.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done is not closed")
+	}
+	if cli.Err() != bgErr || pc.Err() != bgErr {
+		t.Fatal("unexpected error", cli.Err())
+	}
+}
+
+func TestWriteDropKeepsConn(t *testing.T) {
+	quicConn := &fakeQuicConn{}
+	cli := newTestClient(quicConn)
+	pc := listenTestPacket(t, cli, "1.1.1.1:53")
+	var dropErr *WriteDropError
+	if _, err := pc.WriteTo([]byte("hello"), "bad target"); !errors.As(err, &dropErr) || dropErr.Reason != WriteDropBadTarget {
+		t.Fatal("unexpected error", err)
+	}
+	if _, err := pc.WriteTo(make([]byte, 0x10000), "1.1.1.1:53"); !errors.As(err, &dropErr) || dropErr.Reason != WriteDropTooLarge {
+		t.Fatal("unexpected error", err)
+	}
+	if cli.Err() != nil || quicConn.isClosed() {
+		t.Fatal("a dropped packet closes the connection", cli.Err())
+	}
+	if _, err := pc.WriteTo([]byte("hello"), "1.1.1.1:53"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUniStreamMaxPacketSize(t *testing.T) {
+	quicConn := &fakeQuicConn{incomingStreams: make(chan quic.ReceiveStream, 1)}
+	cli := newTestClient(quicConn)
+	cli.UdpRelayMode = common.QUIC
+	cli.MaxUdpRelayPacketSize = 5
+	go func() {
+		_ = cli.handleUniStream(quicConn)
+	}()
+	pc := listenTestPacket(t, cli, "1.1.1.1:53")
+	defer pc.Close()
+	buf := new(bytes.Buffer)
+	for _, payload := range []string{"short", "too long"} {
+		packet := NewPacket(pc.connId, 0, 1, 0, uint16(len(payload)), NewAddressAddrPort(netip.MustParseAddrPort("1.1.1.1:53")), []byte(payload), Ver5)
+		if err := packet.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream := &fakeReceiveStream{reader: buf, canceled: make(chan struct{})}
+	quicConn.incomingStreams <- stream
+	select {
+	case <-stream.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the stream is not dropped")
+	}
+	b := make([]byte, 16)
+	n, _, err := pc.ReadFrom(b)
+	if err != nil || string(b[:n]) != "short" {
+		t.Fatal(string(b[:n]), err)
+	}
+	_ = pc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, _, err = pc.ReadFrom(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("a packet too large is received", string(b[:n]), err)
+	}
+	if cli.Err() != nil || quicConn.isClosed() {
+		t.Fatal("a packet too large closes the connection", cli.Err())
+	}
+}
+
+func TestDissociateBeforeClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	quicConn := &fakeQuicConn{ctx: ctx}
+	cli := newTestClient(quicConn)
+	active := map[uint16]bool{
+		listenTestPacket(t, cli, "1.1.1.1:53").connId: true,
+		listenTestPacket(t, cli, "8.8.8.8:53").connId: true,
+	}
+	closed := listenTestPacket(t, cli, "9.9.9.9:53")
+	if err := closed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate an idle timeout reported by a background loop, after which the
+	// connection is gone within the grace period.
+	cli.deferQuicConn(quicConn, errors.New("timeout: no recent network activity"))
+	cancel()
+
+	quicConn.mu.Lock()
+	defer quicConn.mu.Unlock()
+	dissociated := make(map[uint16]int)
+	for _, stream := range quicConn.uniStreams {
+		d, err := ReadDissociate(bufio.NewReader(&stream.buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !stream.closed {
+			t.Fatal("stream is not closed")
+		}
+		dissociated[d.ASSOC_ID]++
+	}
+	if len(dissociated) != 3 || dissociated[closed.connId] != 1 {
+		t.Fatal("unexpected dissociates", dissociated)
+	}
+	for connId := range active {
+		if dissociated[connId] != 1 {
+			t.Fatal("session is not dissociated once", connId, dissociated)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	from, to := &fakeQuicConn{}, &fakeQuicConn{}
+	cli := newTestClient(from)
+	pc := listenTestPacket(t, cli, "1.1.1.1:53")
+	closed := listenTestPacket(t, cli, "8.8.8.8:53")
+	if err := closed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cli.connMutex.Lock()
+	cli.quicConn = to
+	cli.connMutex.Unlock()
+	cli.udpSessions.Range(func(key, value any) bool {
+		value.(*quicStreamPacketConn).migrate(from, to, nil)
+		return true
+	})
+	if _, err := pc.WriteTo([]byte("hello"), "1.1.1.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	if len(from.sentPackets(t)) != 0 || len(to.sentPackets(t)) != 1 {
+		t.Fatal("the packet is not sent on the new connection")
+	}
+	// Each session is dissociated once on the old connection.
+	from.mu.Lock()
+	if len(from.uniStreams) != 2 {
+		t.Fatal("unexpected dissociates", len(from.uniStreams))
+	}
+	from.mu.Unlock()
+	// Failures of the old connection do not close the client.
+	cli.deferQuicConn(from, errors.New("timeout: no recent network activity"))
+	if cli.Err() != nil {
+		t.Fatal("the client is closed by the old connection", cli.Err())
+	}
+	if err := pc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	to.mu.Lock()
+	defer to.mu.Unlock()
+	if len(to.uniStreams) != 1 {
+		t.Fatal("the session is not dissociated on the new connection")
+	}
+}
+
+type fakeEarlyConn struct {
+	*fakeQuicConn
+	handshakeComplete chan struct{}
+
+	mu          sync.Mutex
+	controllers []string
+}
+
+func (c *fakeEarlyConn) HandshakeComplete() <-chan struct{} {
+	return c.handshakeComplete
+}
+
+func (c *fakeEarlyConn) NextConnection() quic.Connection {
+	return c
+}
+
+func (c *fakeEarlyConn) SetCongestionControl(cc congestion.CongestionControl) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.controllers = append(c.controllers, fmt.Sprintf("%T", cc))
+}
+
+func (c *fakeEarlyConn) controller() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.controllers) == 0 {
+		return ""
+	}
+	return c.controllers[len(c.controllers)-1]
+}
+
+func TestHandshakeCongestion(t *testing.T) {
+	quicConn := &fakeEarlyConn{fakeQuicConn: &fakeQuicConn{}, handshakeComplete: make(chan struct{})}
+	common.SetHandshakeCongestionController(quicConn, "new_reno", "bbr", 10)
+	if cc := quicConn.controller(); cc != "*congestion.cubicSender" {
+		t.Fatal("unexpected handshake controller", cc)
+	}
+	close(quicConn.handshakeComplete)
+	deadline := time.Now().Add(time.Second)
+	for quicConn.controller() != "*congestion.bbrSender" {
+		if time.Now().After(deadline) {
+			t.Fatal("the data controller is not set after the handshake", quicConn.controller())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
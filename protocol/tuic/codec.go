@@ -0,0 +1,34 @@
+package tuic
+
+// PacketCodec encodes and decodes the Packet command of a TUIC wire version.
+// Fragments are sized for the framing of TUIC v5, so a codec must not encode a
+// packet into more bytes than it does.
+type PacketCodec interface {
+	// Encode writes the packet to writer.
+	Encode(writer BufferedWriter, packet *Packet) error
+	// Decode reads a packet whose command head has been read.
+	Decode(head *CommandHead, reader BufferedReader) (*Packet, error)
+}
+
+// limitedDecoder is implemented by codecs that can reject a packet larger than
+// maxSize before reading its data, which PacketReader prefers to Decode.
+type limitedDecoder interface {
+	decodeLimited(head *CommandHead, reader BufferedReader, maxSize int) (*Packet, error)
+}
+
+// DefaultPacketCodec is the framing of TUIC v5.
+var DefaultPacketCodec PacketCodec = packetCodecV5{}
+
+type packetCodecV5 struct{}
+
+func (packetCodecV5) Encode(writer BufferedWriter, packet *Packet) error {
+	return packet.WriteTo(writer)
+}
+
+func (packetCodecV5) Decode(head *CommandHead, reader BufferedReader) (*Packet, error) {
+	return ReadPacketWithHead(head, reader)
+}
+
+func (packetCodecV5) decodeLimited(head *CommandHead, reader BufferedReader, maxSize int) (*Packet, error) {
+	return readPacketWithHead(head, reader, maxSize)
+}
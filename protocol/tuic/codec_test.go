@@ -0,0 +1,66 @@
+package tuic
+
+import (
+	"bytes"
+	"testing"
+)
+
+// xorCodec is the v5 framing with the payload masked.
+type xorCodec struct{}
+
+func xorBytes(b []byte) []byte {
+	masked := make([]byte, len(b))
+	for i := range b {
+		masked[i] = b[i] ^ 0x5a
+	}
+	return masked
+}
+
+func (xorCodec) Encode(writer BufferedWriter, packet *Packet) error {
+	masked := *packet
+	masked.DATA = xorBytes(packet.DATA)
+	return DefaultPacketCodec.Encode(writer, &masked)
+}
+
+func (xorCodec) Decode(head *CommandHead, reader BufferedReader) (*Packet, error) {
+	packet, err := DefaultPacketCodec.Decode(head, reader)
+	if err != nil {
+		return nil, err
+	}
+	packet.DATA = xorBytes(packet.DATA)
+	return packet, nil
+}
+
+func TestPacketCodec(t *testing.T) {
+	quicConn := &fakeQuicConn{incoming: make(chan []byte, 8)}
+	cli := newTestClient(quicConn)
+	cli.PacketCodec = xorCodec{}
+	go func() {
+		_ = cli.handleMessage(quicConn)
+	}()
+	pc := listenTestPacket(t, cli, "1.1.1.1:53")
+	defer pc.Close()
+	// Large enough to be fragmented.
+	payload := bytes.Repeat([]byte("payload "), 300)
+	if _, err := pc.WriteTo(payload, "1.1.1.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	sent := quicConn.sentPackets(t)
+	if len(sent) < 2 || bytes.Contains(sent[0].DATA, []byte("payload")) {
+		t.Fatal("the codec is not used for encoding")
+	}
+	// Loop the datagrams back.
+	quicConn.mu.Lock()
+	for _, m := range quicConn.messages {
+		quicConn.incoming <- m
+	}
+	quicConn.mu.Unlock()
+	buf := make([]byte, 4096)
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], payload) || addr.String() != "1.1.1.1:53" {
+		t.Fatal("unexpected packet", n, addr)
+	}
+}
@@ -13,6 +13,21 @@ const (
 	MaxConnectionReceiveWindow     = 64 * 1024 * 1024 // 64 MB
 )
 
+// SetHandshakeCongestionController sets handshakeCC on quicConn until its
+// handshake completes, and then switches to cc. The controller of a live
+// connection can be replaced, but the new one starts over without the state of
+// the old one.
+func SetHandshakeCongestionController(quicConn quic.EarlyConnection, handshakeCC string, cc string, cwnd int) {
+	SetCongestionController(quicConn, handshakeCC, cwnd)
+	go func() {
+		select {
+		case <-quicConn.HandshakeComplete():
+			SetCongestionController(quicConn, cc, cwnd)
+		case <-quicConn.Context().Done():
+		}
+	}()
+}
+
 func SetCongestionController(quicConn quic.Connection, cc string, cwnd int) {
 	CWND := c.ByteCount(cwnd)
 	switch cc {
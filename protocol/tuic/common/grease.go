@@ -0,0 +1,36 @@
+package common
+
+import (
+	"crypto/tls"
+
+	"github.com/daeuniverse/softwind/pkg/fastrand"
+)
+
+// WithGreaseAlpn returns a copy of config with a random GREASE ALPN value
+// (RFC 8701) inserted at a random position of NextProtos, making the
+// ClientHello less fingerprintable. Servers ignore unknown protocols.
+//
+// The TLS stack used by QUIC has no way to randomize the extension order, so
+// only ALPN is greased.
+func WithGreaseAlpn(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	// GREASE values are 0x0A0A, 0x1A1A, ..., 0xFAFA.
+	b := byte(fastrand.Intn(16))<<4 | 0x0A
+	grease := string([]byte{b, b})
+	pos := fastrand.Intn(len(config.NextProtos) + 1)
+	nextProtos := make([]string, 0, len(config.NextProtos)+1)
+	nextProtos = append(nextProtos, config.NextProtos[:pos]...)
+	nextProtos = append(nextProtos, grease)
+	nextProtos = append(nextProtos, config.NextProtos[pos:]...)
+	config.NextProtos = nextProtos
+	return config
+}
+
+// IsGreaseAlpn reports whether proto is a GREASE ALPN value.
+func IsGreaseAlpn(proto string) bool {
+	return len(proto) == 2 && proto[0] == proto[1] && proto[0]&0x0F == 0x0A
+}
@@ -0,0 +1,428 @@
+package tuic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/pkg/cert"
+	"github.com/daeuniverse/softwind/pkg/fastrand"
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/daeuniverse/softwind/protocol/direct"
+	"github.com/daeuniverse/softwind/protocol/tuic/common"
+	"github.com/google/uuid"
+	"github.com/mzz2017/quic-go"
+	"github.com/mzz2017/quic-go/logging"
+)
+
+const (
+	UdpRelayModeNative = "native"
+	UdpRelayModeQuic   = "quic"
+)
+
+// Address families of the UDP socket to the server.
+const (
+	UdpBindDual = "dual"
+	UdpBindV4   = "v4"
+	UdpBindV6   = "v6"
+)
+
+const (
+	DefaultMaxUdpRelayPacketSize = 1400
+	// DefaultKeepAlivePeriod is the period of QUIC keep-alives, which are the
+	// heartbeats of the connection.
+	DefaultKeepAlivePeriod = 3 * time.Second
+	MaxHeartbeatJitter     = 50
+	// MinConnectionIdLength and MaxConnectionIdLength bound the lengths of
+	// connection IDs quic-go generates.
+	MinConnectionIdLength = 4
+	MaxConnectionIdLength = 18
+)
+
+var ErrInvalidConfig = errors.New("invalid TUIC config")
+
+// ClientConfig is the complete configuration of a TUIC client, for callers
+// that build it programmatically rather than from a proxy link.
+type ClientConfig struct {
+	// NextDialer dials the UDP conn to the server. direct.SymmetricDirect is
+	// used if nil.
+	NextDialer netproxy.Dialer
+	Server     string
+	Port       uint16
+	Uuid       string
+	Password   string
+	// UdpRelayMode is UdpRelayModeNative or UdpRelayModeQuic. It is
+	// UdpRelayModeNative if empty.
+	UdpRelayMode string
+	// CongestionController is one of "bbr", "cubic" and "new_reno". Others
+	// fall back to "bbr".
+	CongestionController string
+	// HandshakeCongestion, if it is not empty, is the congestion controller
+	// used until the handshake completes, after which CongestionController
+	// takes over. It only takes effect with ReduceRtt: otherwise the
+	// connection is not available before the handshake completes, which runs
+	// with the builtin controller of quic-go.
+	HandshakeCongestion string
+	// MaxUdpRelayPacketSize is DefaultMaxUdpRelayPacketSize if 0. In QUIC
+	// relay mode it also bounds the packets received on uni-streams.
+	MaxUdpRelayPacketSize int
+	TlsConfig             *tls.Config
+	// MtuOverrides maps targets known to sit behind smaller MTU paths to the
+	// max UDP relay packet sizes used for them in native mode instead of
+	// MaxUdpRelayPacketSize, which an override cannot exceed. A target is an
+	// IP, a CIDR or a domain, which also matches its subdomains, as in
+	// protocol.TargetMatcher. The most specific matching target wins.
+	MtuOverrides map[string]int
+	// PinSha256 is a set of SHA-256 hashes, one of which the leaf certificate
+	// of the server must match if it is not empty.
+	PinSha256  [][32]byte
+	GreaseAlpn bool
+	// ReduceRtt sends data in 0-RTT when resuming a TLS session, which needs
+	// TlsConfig.ClientSessionCache.
+	ReduceRtt bool
+	// Disable0RTT never offers 0-RTT data, which can be replayed by an
+	// attacker, even if ReduceRtt is set or a resumed session allows it.
+	// Connections then take a full round trip before sending data, as new
+	// ones do.
+	Disable0RTT bool
+
+	SequentialPktId      bool
+	PadMultiple          int
+	InboundPacketsPerSec int
+	InboundBytesPerSec   int
+	// ReorderWindow is how far out of order the fragments of an incoming
+	// packet may arrive. Once the highest fragment held is more than it ahead
+	// of the lowest missing one, the packet is dropped as lost. 0 means no
+	// limit.
+	ReorderWindow int
+	// HeartbeatJitter randomizes the keep-alive period of each connection by up
+	// to this percentage in either direction, so that clients do not send
+	// keep-alives in step. It is in range [0, MaxHeartbeatJitter].
+	HeartbeatJitter int
+	// UdpBind is the address family of the UDP socket to the server:
+	// UdpBindDual for a dual-stack IPv6 socket, UdpBindV4 or UdpBindV6. If
+	// empty, it matches the address of the server.
+	UdpBind string
+	// SessionsPerSec limits how frequently UDP sessions are created, with
+	// bursts of one second. 0 means no limit. Once it is reached, new sessions
+	// fail with ErrSessionRateLimited, or wait if BlockOnSessionLimit is set.
+	SessionsPerSec      int
+	BlockOnSessionLimit bool
+	// DefaultWriteTimeout makes a write to a UDP session fail with
+	// os.ErrDeadlineExceeded if it does not complete in time, unless a write
+	// deadline is set. 0 disables it.
+	DefaultWriteTimeout time.Duration
+	// MaxConnLifetime makes the client replace its connection to the server
+	// with a fresh one once it is this old. UDP sessions move to the new
+	// connection, while TCP streams stay on the old one until they are closed.
+	// 0 disables it.
+	MaxConnLifetime time.Duration
+	// ConnectionIdLength is the length of the connection IDs the client
+	// chooses, in range [MinConnectionIdLength, MaxConnectionIdLength]. If it
+	// is 0, the default of quic-go is used, which is zero-length connection
+	// IDs as the client has a UDP socket of its own.
+	ConnectionIdLength int
+
+	// DebugHandshake passes the outbound handshake datagrams, which carry the
+	// ClientHello, to OnHandshakeBytes in hex for debugging handshakes blocked
+	// by middleboxes. It is verbose and exposes the SNI and other details of
+	// the handshake, so keep it off otherwise.
+	DebugHandshake   bool
+	OnHandshakeBytes func(hexBytes string)
+	// Qlog writes a qlog trace of each connection for debugging, to the writer
+	// NewQlogWriter returns for it, or otherwise to a file in QlogDir. It is
+	// verbose and exposes the details of connections, so keep it off
+	// otherwise.
+	Qlog    bool
+	QlogDir string
+	// NewQlogWriter returns the writer of the trace of the connection with the
+	// original destination connection ID connectionId, given in hex. The
+	// writer is closed once the connection is. If it fails, the connection is
+	// not traced.
+	NewQlogWriter func(connectionId string) (io.WriteCloser, error)
+}
+
+// Validate checks the config.
+func (c *ClientConfig) Validate() error {
+	if c.Server == "" {
+		return fmt.Errorf("%w: no server", ErrInvalidConfig)
+	}
+	if c.Port == 0 {
+		return fmt.Errorf("%w: no port", ErrInvalidConfig)
+	}
+	if _, err := uuid.Parse(c.Uuid); err != nil {
+		return fmt.Errorf("%w: parse UUID: %v", ErrInvalidConfig, err)
+	}
+	switch c.UdpRelayMode {
+	case "", UdpRelayModeNative, UdpRelayModeQuic:
+	default:
+		return fmt.Errorf("%w: unknown UDP relay mode: %v", ErrInvalidConfig, c.UdpRelayMode)
+	}
+	switch c.UdpBind {
+	case "", UdpBindDual, UdpBindV4, UdpBindV6:
+	default:
+		return fmt.Errorf("%w: unknown UDP bind: %v", ErrInvalidConfig, c.UdpBind)
+	}
+	if c.TlsConfig == nil {
+		return fmt.Errorf("%w: no TLS config", ErrInvalidConfig)
+	}
+	maxUdpRelayPacketSize := c.maxUdpRelayPacketSize()
+	if maxUdpRelayPacketSize < 1 || maxUdpRelayPacketSize > 0xffff {
+		return fmt.Errorf("%w: bad max UDP relay packet size: %v", ErrInvalidConfig, c.MaxUdpRelayPacketSize)
+	}
+	if _, err := newMtuOverrides(c.MtuOverrides, maxUdpRelayPacketSize); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	if c.PadMultiple < 0 || c.PadMultiple > maxUdpRelayPacketSize {
+		return fmt.Errorf("%w: bad pad multiple: should be in range [0, %v]", ErrInvalidConfig, maxUdpRelayPacketSize)
+	}
+	if c.InboundPacketsPerSec < 0 || c.InboundBytesPerSec < 0 {
+		return fmt.Errorf("%w: negative inbound limit", ErrInvalidConfig)
+	}
+	if c.ReorderWindow < 0 {
+		return fmt.Errorf("%w: negative reorder window", ErrInvalidConfig)
+	}
+	if c.HeartbeatJitter < 0 || c.HeartbeatJitter > MaxHeartbeatJitter {
+		return fmt.Errorf("%w: bad heartbeat jitter: should be in range [0, %v]", ErrInvalidConfig, MaxHeartbeatJitter)
+	}
+	if c.SessionsPerSec < 0 {
+		return fmt.Errorf("%w: negative session limit", ErrInvalidConfig)
+	}
+	if c.DefaultWriteTimeout < 0 {
+		return fmt.Errorf("%w: negative write timeout", ErrInvalidConfig)
+	}
+	if c.ConnectionIdLength != 0 && (c.ConnectionIdLength < MinConnectionIdLength || c.ConnectionIdLength > MaxConnectionIdLength) {
+		return fmt.Errorf("%w: bad connection ID length: should be in range [%v, %v]", ErrInvalidConfig, MinConnectionIdLength, MaxConnectionIdLength)
+	}
+	if c.MaxConnLifetime < 0 {
+		return fmt.Errorf("%w: negative connection lifetime", ErrInvalidConfig)
+	}
+	if c.Qlog && c.NewQlogWriter == nil && c.QlogDir == "" {
+		return fmt.Errorf("%w: no qlog destination", ErrInvalidConfig)
+	}
+	if c.DebugHandshake && c.OnHandshakeBytes == nil {
+		return fmt.Errorf("%w: no handshake bytes hook for debugging", ErrInvalidConfig)
+	}
+	return nil
+}
+
+func (c *ClientConfig) maxUdpRelayPacketSize() int {
+	if c.MaxUdpRelayPacketSize == 0 {
+		return DefaultMaxUdpRelayPacketSize
+	}
+	return c.MaxUdpRelayPacketSize
+}
+
+// NewClient returns a Dialer of the config.
+func NewClient(config ClientConfig) (*Dialer, error) {
+	return newDialer(config, true)
+}
+
+// configFromHeader converts the header of a proxy link to a ClientConfig.
+func configFromHeader(nextDialer netproxy.Dialer, header protocol.Header) (config ClientConfig, err error) {
+	host, port, err := net.SplitHostPort(header.ProxyAddress)
+	if err != nil {
+		return ClientConfig{}, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return ClientConfig{}, fmt.Errorf("parse port: %w", err)
+	}
+	config = ClientConfig{
+		NextDialer:           nextDialer,
+		Server:               host,
+		Port:                 uint16(portNum),
+		Uuid:                 header.User,
+		Password:             header.Password,
+		UdpRelayMode:         UdpRelayModeNative,
+		CongestionController: header.Feature1,
+		HandshakeCongestion:  header.Params.Get("handshakeCongestion"),
+		TlsConfig:            header.TlsConfig,
+		UdpBind:              header.Params.Get("udpBind"),
+	}
+	if header.Flags&protocol.Flags_Tuic_UdpRelayModeQuic > 0 {
+		// FIXME: QUIC has severe performance problems.
+		// config.UdpRelayMode = UdpRelayModeQuic
+	}
+	if v := header.Params.Get("disable0RTT"); v != "" {
+		if config.Disable0RTT, err = strconv.ParseBool(v); err != nil {
+			return ClientConfig{}, fmt.Errorf("parse disable0RTT: %w", err)
+		}
+	}
+	switch v := header.Params.Get("pktId"); v {
+	case "", "random":
+	case "sequential":
+		config.SequentialPktId = true
+	default:
+		return ClientConfig{}, fmt.Errorf("parse pktId: unknown allocation: %v", v)
+	}
+	if v := header.Params.Get("greaseAlpn"); v != "" {
+		if config.GreaseAlpn, err = strconv.ParseBool(v); err != nil {
+			return ClientConfig{}, fmt.Errorf("parse greaseAlpn: %w", err)
+		}
+	}
+	if v := header.Params.Get("reduceRtt"); v != "" {
+		if config.ReduceRtt, err = strconv.ParseBool(v); err != nil {
+			return ClientConfig{}, fmt.Errorf("parse reduceRtt: %w", err)
+		}
+	}
+	if v := header.Params.Get("blockOnSessionLimit"); v != "" {
+		if config.BlockOnSessionLimit, err = strconv.ParseBool(v); err != nil {
+			return ClientConfig{}, fmt.Errorf("parse blockOnSessionLimit: %w", err)
+		}
+	}
+	if v := header.Params.Get("writeTimeout"); v != "" {
+		if config.DefaultWriteTimeout, err = time.ParseDuration(v); err != nil {
+			return ClientConfig{}, fmt.Errorf("parse writeTimeout: %w", err)
+		}
+	}
+	if v := header.Params.Get("maxConnLifetime"); v != "" {
+		if config.MaxConnLifetime, err = time.ParseDuration(v); err != nil {
+			return ClientConfig{}, fmt.Errorf("parse maxConnLifetime: %w", err)
+		}
+	}
+	if pins := header.Params.Get("pinSHA256"); pins != "" {
+		if config.PinSha256, err = cert.ParseSha256Pins(pins); err != nil {
+			return ClientConfig{}, fmt.Errorf("parse pinSHA256: %w", err)
+		}
+	}
+	if config.PadMultiple, err = intParam(header, "padMultiple", 0, DefaultMaxUdpRelayPacketSize); err != nil {
+		return ClientConfig{}, err
+	}
+	if config.InboundPacketsPerSec, err = intParam(header, "inboundPacketsPerSec", 0, math.MaxInt32); err != nil {
+		return ClientConfig{}, err
+	}
+	if config.InboundBytesPerSec, err = intParam(header, "inboundBytesPerSec", 0, math.MaxInt32); err != nil {
+		return ClientConfig{}, err
+	}
+	if config.ReorderWindow, err = intParam(header, "reorderWindow", 0, 0xff); err != nil {
+		return ClientConfig{}, err
+	}
+	if config.HeartbeatJitter, err = intParam(header, "heartbeatJitter", 0, MaxHeartbeatJitter); err != nil {
+		return ClientConfig{}, err
+	}
+	if config.SessionsPerSec, err = intParam(header, "sessionsPerSec", 0, math.MaxInt32); err != nil {
+		return ClientConfig{}, err
+	}
+	if config.ConnectionIdLength, err = intParam(header, "connectionIdLength", MinConnectionIdLength, MaxConnectionIdLength); err != nil {
+		return ClientConfig{}, err
+	}
+	if v := header.Params.Get("qlog"); v != "" {
+		if config.Qlog, err = strconv.ParseBool(v); err != nil {
+			return ClientConfig{}, fmt.Errorf("parse qlog: %w", err)
+		}
+		config.QlogDir = header.Params.Get("qlogDir")
+	}
+	return config, nil
+}
+
+func newDialer(config ClientConfig, isClient bool) (*Dialer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	id := uuid.MustParse(config.Uuid)
+	tlsConfig := config.TlsConfig
+	if len(config.PinSha256) > 0 {
+		tlsConfig = cert.WithSha256Pins(tlsConfig, config.PinSha256)
+	}
+	if config.Disable0RTT {
+		tlsConfig = withoutEarlyData(tlsConfig)
+	}
+	udpRelayMode := common.NATIVE
+	if config.UdpRelayMode == UdpRelayModeQuic {
+		udpRelayMode = common.QUIC
+	}
+	nextDialer := config.NextDialer
+	if nextDialer == nil {
+		nextDialer = direct.SymmetricDirect
+	}
+	// ensure server's incoming stream can handle correctly, increase to 1.1x
+	maxDatagramFrameSize := config.maxUdpRelayPacketSize()
+	mtuOverrides, err := newMtuOverrides(config.MtuOverrides, maxDatagramFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	var sessionLimiter *tokenBucket
+	if config.SessionsPerSec > 0 {
+		sessionLimiter = newTokenBucket(float64(config.SessionsPerSec), float64(config.SessionsPerSec))
+	}
+	var onHandshakeBytes func(hexBytes string)
+	if config.DebugHandshake {
+		onHandshakeBytes = config.OnHandshakeBytes
+	}
+	var tracer func(context.Context, logging.Perspective, quic.ConnectionID) logging.ConnectionTracer
+	if config.Qlog {
+		newQlogWriter := config.NewQlogWriter
+		if newQlogWriter == nil {
+			newQlogWriter = qlogDirWriter(config.QlogDir)
+		}
+		tracer = qlogTracer(newQlogWriter)
+	}
+	return &Dialer{
+		clientRing: newClientRing(func(capabilityCallback func(n int64)) *clientImpl {
+			return &clientImpl{
+				ClientOption: &ClientOption{
+					TlsConfig: tlsConfig,
+					QuicConfig: &quic.Config{
+						InitialStreamReceiveWindow:     common.InitialStreamReceiveWindow,
+						MaxStreamReceiveWindow:         common.MaxStreamReceiveWindow,
+						InitialConnectionReceiveWindow: common.InitialConnectionReceiveWindow,
+						MaxConnectionReceiveWindow:     common.MaxConnectionReceiveWindow,
+						KeepAlivePeriod:                DefaultKeepAlivePeriod,
+						DisablePathMTUDiscovery:        false,
+						MaxDatagramFrameSize:           int64(maxDatagramFrameSize + PacketOverHead),
+						EnableDatagrams:                true,
+						HandshakeIdleTimeout:           8 * time.Second,
+						CapabilityCallback:             capabilityCallback,
+						Tracer:                         tracer,
+					},
+					Uuid:                  id,
+					Password:              config.Password,
+					UdpRelayMode:          udpRelayMode,
+					CongestionController:  config.CongestionController,
+					HandshakeCongestion:   config.HandshakeCongestion,
+					ReduceRtt:             config.ReduceRtt && !config.Disable0RTT,
+					CWND:                  10,
+					MaxUdpRelayPacketSize: maxDatagramFrameSize,
+					MtuOverrides:          mtuOverrides,
+					SequentialPktId:       config.SequentialPktId,
+					PadMultiple:           config.PadMultiple,
+					InboundPacketsPerSec:  config.InboundPacketsPerSec,
+					InboundBytesPerSec:    config.InboundBytesPerSec,
+					ReorderWindow:         config.ReorderWindow,
+					DefaultWriteTimeout:   config.DefaultWriteTimeout,
+					MaxConnLifetime:       config.MaxConnLifetime,
+					GreaseAlpn:            config.GreaseAlpn,
+					HeartbeatJitter:       config.HeartbeatJitter,
+				},
+				udp: true,
+			}
+		}, 10),
+		proxyAddress: net.JoinHostPort(config.Server, strconv.Itoa(int(config.Port))),
+		nextDialer:   nextDialer,
+		metadata: protocol.Metadata{
+			IsClient: isClient,
+		},
+		udpBind:             config.UdpBind,
+		sessionLimiter:      sessionLimiter,
+		blockOnSessionLimit: config.BlockOnSessionLimit,
+		onHandshakeBytes:    onHandshakeBytes,
+		connectionIdLength:  config.ConnectionIdLength,
+	}, nil
+}
+
+// jitterDuration returns d changed randomly by up to percent percent.
+func jitterDuration(d time.Duration, percent int) time.Duration {
+	if percent <= 0 {
+		return d
+	}
+	maxJitter := int64(d) * int64(percent) / 100
+	return d + time.Duration(fastrand.Int63n(2*maxJitter+1)-maxJitter)
+}
@@ -0,0 +1,819 @@
+package tuic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/protocol/direct"
+	"github.com/mzz2017/quic-go"
+)
+
+const testUuid = "00000000-0000-0000-0000-000000000000"
+
+func TestClientConfigValidate(t *testing.T) {
+	valid := ClientConfig{
+		Server:    "example.com",
+		Port:      443,
+		Uuid:      testUuid,
+		TlsConfig: &tls.Config{NextProtos: []string{"h3"}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		name   string
+		modify func(c *ClientConfig)
+	}{
+		{"no server", func(c *ClientConfig) { c.Server = "" }},
+		{"no port", func(c *ClientConfig) { c.Port = 0 }},
+		{"bad uuid", func(c *ClientConfig) { c.Uuid = "not-a-uuid" }},
+		{"bad relay mode", func(c *ClientConfig) { c.UdpRelayMode = "tcp" }},
+		{"no tls", func(c *ClientConfig) { c.TlsConfig = nil }},
+		{"bad packet size", func(c *ClientConfig) { c.MaxUdpRelayPacketSize = -1 }},
+		{"bad pad multiple", func(c *ClientConfig) { c.PadMultiple = 2000 }},
+		{"negative inbound limit", func(c *ClientConfig) { c.InboundBytesPerSec = -1 }},
+		{"bad heartbeat jitter", func(c *ClientConfig) { c.HeartbeatJitter = 80 }},
+		{"bad udp bind", func(c *ClientConfig) { c.UdpBind = "v5" }},
+		{"negative session limit", func(c *ClientConfig) { c.SessionsPerSec = -1 }},
+		{"debug handshake without hook", func(c *ClientConfig) { c.DebugHandshake = true }},
+		{"qlog without destination", func(c *ClientConfig) { c.Qlog = true }},
+		{"negative write timeout", func(c *ClientConfig) { c.DefaultWriteTimeout = -time.Second }},
+		{"negative connection lifetime", func(c *ClientConfig) { c.MaxConnLifetime = -time.Second }},
+		{"negative reorder window", func(c *ClientConfig) { c.ReorderWindow = -1 }},
+		{"bad MTU override", func(c *ClientConfig) { c.MtuOverrides = map[string]int{"10.0.0.0/8": 0} }},
+		{"bad connection ID length", func(c *ClientConfig) { c.ConnectionIdLength = MaxConnectionIdLength + 1 }},
+	}
+	for _, test := range tt {
+		config := valid
+		test.modify(&config)
+		if err := config.Validate(); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatal(test.name, err)
+		}
+		if _, err := NewClient(config); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatal(test.name, "NewClient:", err)
+		}
+	}
+}
+
+func newTestTlsConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"h3"},
+	}
+}
+
+// serveTestTuic accepts TUIC connections and echoes the TCP relay streams. It
+// does not check authentication.
+func serveTestTuic(t *testing.T) *net.UDPAddr {
+	lis, err := quic.ListenAddrEarly("127.0.0.1:0", newTestTlsConfig(t), &quic.Config{EnableDatagrams: true, Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go func() {
+						defer stream.Close()
+						reader := bufio.NewReader(stream)
+						if _, err := ReadConnect(reader); err != nil {
+							return
+						}
+						_, _ = io.Copy(stream, reader)
+					}()
+				}
+			}()
+		}
+	}()
+	return lis.Addr().(*net.UDPAddr)
+}
+
+func TestNewClientDial(t *testing.T) {
+	serverAddr := serveTestTuic(t)
+	d, err := NewClient(ClientConfig{
+		Server:    "127.0.0.1",
+		Port:      uint16(serverAddr.Port),
+		Uuid:      testUuid,
+		Password:  "password",
+		TlsConfig: &tls.Config{NextProtos: []string{"h3"}, ServerName: "example.com", InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatal(string(buf))
+	}
+}
+
+type countingDialer struct {
+	netproxy.Dialer
+	dials int32
+}
+
+func (d *countingDialer) Dial(network string, addr string) (netproxy.Conn, error) {
+	atomic.AddInt32(&d.dials, 1)
+	return d.Dialer.Dial(network, addr)
+}
+
+func TestConcurrentDialsShareHandshake(t *testing.T) {
+	serverAddr := serveTestTuic(t)
+	nextDialer := &countingDialer{Dialer: direct.SymmetricDirect}
+	d, err := NewClient(ClientConfig{
+		NextDialer: nextDialer,
+		Server:     "127.0.0.1",
+		Port:       uint16(serverAddr.Port),
+		Uuid:       testUuid,
+		TlsConfig:  &tls.Config{NextProtos: []string{"h3"}, ServerName: "example.com", InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := d.Dial("tcp", "example.com:80")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_ = c.Close()
+		}()
+	}
+	wg.Wait()
+	if dials := atomic.LoadInt32(&nextDialer.dials); dials != 1 {
+		t.Fatal("expected one handshake, got", dials)
+	}
+}
+
+func TestDebugHandshake(t *testing.T) {
+	serverAddr := serveTestTuic(t)
+	dial := func(debug bool) []string {
+		var mu sync.Mutex
+		var captured []string
+		d, err := NewClient(ClientConfig{
+			Server:         "127.0.0.1",
+			Port:           uint16(serverAddr.Port),
+			Uuid:           testUuid,
+			TlsConfig:      &tls.Config{NextProtos: []string{"h3"}, ServerName: "example.com", InsecureSkipVerify: true},
+			DebugHandshake: debug,
+			OnHandshakeBytes: func(hexBytes string) {
+				mu.Lock()
+				defer mu.Unlock()
+				captured = append(captured, hexBytes)
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := d.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		return captured
+	}
+	captured := dial(true)
+	if len(captured) == 0 || captured[0] == "" {
+		t.Fatal("no handshake bytes are captured")
+	}
+	// The first datagram is an Initial packet.
+	if b, err := hex.DecodeString(captured[0]); err != nil || b[0]&0xf0 != 0xc0 {
+		t.Fatal("unexpected handshake bytes", captured[0][:8], err)
+	}
+	if captured := dial(false); len(captured) != 0 {
+		t.Fatal("handshake bytes are captured with debugging off")
+	}
+}
+
+func TestConnectionIdLength(t *testing.T) {
+	serverAddr := serveTestTuic(t)
+	// initialScidLength returns the length of the source connection ID in the
+	// first Initial packet.
+	initialScidLength := func(length int) int {
+		var mu sync.Mutex
+		var captured []string
+		d, err := NewClient(ClientConfig{
+			Server:             "127.0.0.1",
+			Port:               uint16(serverAddr.Port),
+			Uuid:               testUuid,
+			TlsConfig:          &tls.Config{NextProtos: []string{"h3"}, ServerName: "example.com", InsecureSkipVerify: true},
+			ConnectionIdLength: length,
+			DebugHandshake:     true,
+			OnHandshakeBytes: func(hexBytes string) {
+				mu.Lock()
+				defer mu.Unlock()
+				captured = append(captured, hexBytes)
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := d.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		b, err := hex.DecodeString(captured[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Flags, version, DCID length, DCID and SCID length.
+		dcidLength := int(b[5])
+		return int(b[6+dcidLength])
+	}
+	if length := initialScidLength(0); length != 0 {
+		t.Fatal("unexpected default length", length)
+	}
+	if length := initialScidLength(12); length != 12 {
+		t.Fatal("the configured length is not used", length)
+	}
+}
+
+// qlogBuffer is a qlog writer recording what is written to it.
+type qlogBuffer struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (b *qlogBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *qlogBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+func (b *qlogBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestQlog(t *testing.T) {
+	serverAddr := serveTestTuic(t)
+	var mu sync.Mutex
+	writers := make(map[string]*qlogBuffer)
+	d, err := NewClient(ClientConfig{
+		Server:    "127.0.0.1",
+		Port:      uint16(serverAddr.Port),
+		Uuid:      testUuid,
+		TlsConfig: &tls.Config{NextProtos: []string{"h3"}, ServerName: "example.com", InsecureSkipVerify: true},
+		Qlog:      true,
+		NewQlogWriter: func(connectionId string) (io.WriteCloser, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			w := &qlogBuffer{}
+			writers[connectionId] = w
+			return w, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(writers) != 1 {
+		t.Fatal("unexpected writers", len(writers))
+	}
+	for connectionId, w := range writers {
+		if connectionId == "" {
+			t.Fatal("no connection ID")
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(w.String(), "packet_sent") {
+			if time.Now().After(deadline) {
+				t.Fatal("no packet is traced", w.String())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Without NewQlogWriter, the trace is written to QlogDir.
+	dir := t.TempDir()
+	d, err = NewClient(ClientConfig{
+		Server:    "127.0.0.1",
+		Port:      uint16(serverAddr.Port),
+		Uuid:      testUuid,
+		TlsConfig: &tls.Config{NextProtos: []string{"h3"}, ServerName: "example.com", InsecureSkipVerify: true},
+		Qlog:      true,
+		QlogDir:   dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = d.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	files, err := filepath.Glob(filepath.Join(dir, "*_client.qlog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatal("unexpected trace files", files)
+	}
+}
+
+// traceRecorder records the phases reported to its trace.
+type traceRecorder struct {
+	mu     sync.Mutex
+	phases []string
+	times  []time.Time
+	errs   []error
+}
+
+func (r *traceRecorder) record(phase string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.phases = append(r.phases, phase)
+	r.times = append(r.times, time.Now())
+	if err != nil {
+		r.errs = append(r.errs, fmt.Errorf("%v: %w", phase, err))
+	}
+}
+
+func (r *traceRecorder) trace() *netproxy.DialTrace {
+	return &netproxy.DialTrace{
+		DialStart:     func(network string, addr string) { r.record("start", nil) },
+		ConnectDone:   func(err error) { r.record("connect", err) },
+		HandshakeDone: func(err error) { r.record("handshake", err) },
+		AuthDone:      func(err error) { r.record("auth", err) },
+		DialDone:      func(c netproxy.Conn, err error) { r.record("done", err) },
+	}
+}
+
+// check fails t unless the phases are recorded in order without errors.
+func (r *traceRecorder) check(t *testing.T, phases ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.errs) > 0 {
+		t.Fatal(r.errs)
+	}
+	if strings.Join(r.phases, ",") != strings.Join(phases, ",") {
+		t.Fatal("unexpected phases", r.phases)
+	}
+	for i := 1; i < len(r.times); i++ {
+		if r.times[i].Before(r.times[i-1]) {
+			t.Fatal("phases are not in time order", r.phases[i])
+		}
+	}
+	if elapsed := r.times[len(r.times)-1].Sub(r.times[0]); elapsed > 5*time.Second {
+		t.Fatal("unexpected dial time", elapsed)
+	}
+	r.phases, r.times = nil, nil
+}
+
+func TestTracingDialer(t *testing.T) {
+	serverAddr := serveTestTuic(t)
+	d, err := NewClient(ClientConfig{
+		Server:    "127.0.0.1",
+		Port:      uint16(serverAddr.Port),
+		Uuid:      testUuid,
+		TlsConfig: &tls.Config{NextProtos: []string{"h3"}, ServerName: "example.com", InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &traceRecorder{}
+	tracingDialer := &netproxy.TracingDialer{Dialer: d, Trace: r.trace()}
+	c, err := tracingDialer.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r.check(t, "start", "connect", "handshake", "auth", "done")
+
+	// The connection is reused.
+	c, err = tracingDialer.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r.check(t, "start", "done")
+}
+
+func TestSessionRateLimit(t *testing.T) {
+	serverAddr := serveTestTuic(t)
+	newClient := func(block bool) *Dialer {
+		d, err := NewClient(ClientConfig{
+			Server:              "127.0.0.1",
+			Port:                uint16(serverAddr.Port),
+			Uuid:                testUuid,
+			TlsConfig:           &tls.Config{NextProtos: []string{"h3"}, ServerName: "example.com", InsecureSkipVerify: true},
+			SessionsPerSec:      20,
+			BlockOnSessionLimit: block,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	d := newClient(false)
+	for i := 0; i < 20; i++ {
+		c, err := d.DialUdp("1.1.1.1:53")
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		defer c.Close()
+	}
+	if _, err := d.DialUdp("1.1.1.1:53"); !errors.Is(err, ErrSessionRateLimited) {
+		t.Fatal("expected rate limited, got", err)
+	}
+	// TCP relay is not limited.
+	c, err := d.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+
+	d = newClient(true)
+	start := time.Now()
+	for i := 0; i < 22; i++ {
+		c, err := d.DialUdp("1.1.1.1:53")
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		defer c.Close()
+	}
+	// Two sessions beyond the burst wait for 50ms each.
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatal("sessions are not throttled", elapsed)
+	}
+}
+
+func socketFamily(t *testing.T, conn net.PacketConn) (family int) {
+	rawConn, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rawConn.Control(func(fd uintptr) {
+		sa, err := syscall.Getsockname(int(fd))
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch sa.(type) {
+		case *syscall.SockaddrInet4:
+			family = syscall.AF_INET
+		case *syscall.SockaddrInet6:
+			family = syscall.AF_INET6
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return family
+}
+
+func TestUdpBind(t *testing.T) {
+	serverAddr := serveTestTuic(t)
+	newClient := func(udpBind string) *Dialer {
+		d, err := NewClient(ClientConfig{
+			Server:    "127.0.0.1",
+			Port:      uint16(serverAddr.Port),
+			Uuid:      testUuid,
+			TlsConfig: &tls.Config{NextProtos: []string{"h3"}, ServerName: "example.com", InsecureSkipVerify: true},
+			UdpBind:   udpBind,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	for _, test := range []struct {
+		udpBind string
+		family  int
+	}{
+		{"", syscall.AF_INET},
+		{UdpBindV4, syscall.AF_INET},
+		{UdpBindDual, syscall.AF_INET6},
+	} {
+		d := newClient(test.udpBind)
+		transport, _, err := d.dialFuncFactory("udp", serverAddr)(context.Background(), direct.SymmetricDirect)
+		if err != nil {
+			t.Fatal(test.udpBind, err)
+		}
+		if family := socketFamily(t, transport.Conn); family != test.family {
+			t.Fatal(test.udpBind, "unexpected socket family", family)
+		}
+		_ = transport.Conn.Close()
+		// The server is reachable from the socket.
+		c, err := d.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(test.udpBind, err)
+		}
+		_ = c.Close()
+	}
+	// An IPv6 socket cannot reach an IPv4 server.
+	if _, _, err := newClient(UdpBindV6).dialFuncFactory("udp", serverAddr)(context.Background(), direct.SymmetricDirect); err == nil {
+		t.Fatal("expected error dialing an IPv4 server from an IPv6 socket")
+	}
+}
+
+func TestHeartbeatJitter(t *testing.T) {
+	d, err := NewClient(ClientConfig{
+		Server:          "127.0.0.1",
+		Port:            443,
+		Uuid:            testUuid,
+		TlsConfig:       &tls.Config{NextProtos: []string{"h3"}},
+		HeartbeatJitter: 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	low := DefaultKeepAlivePeriod * 80 / 100
+	high := DefaultKeepAlivePeriod * 120 / 100
+	// Each connection of a client draws its own period.
+	cli := d.clientRing.newClient(nil)
+	periods := make(map[time.Duration]struct{})
+	for i := 0; i < 50; i++ {
+		period := cli.quicConfig().KeepAlivePeriod
+		if period < low || period > high {
+			t.Fatal("period out of the jitter band:", period)
+		}
+		periods[period] = struct{}{}
+	}
+	if len(periods) < 2 {
+		t.Fatal("period does not vary")
+	}
+	if cli.QuicConfig.KeepAlivePeriod != DefaultKeepAlivePeriod {
+		t.Fatal("the given QUIC config is modified")
+	}
+
+	d, err = NewClient(ClientConfig{
+		Server:    "127.0.0.1",
+		Port:      443,
+		Uuid:      testUuid,
+		TlsConfig: &tls.Config{NextProtos: []string{"h3"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if period := d.clientRing.newClient(nil).quicConfig().KeepAlivePeriod; period != DefaultKeepAlivePeriod {
+		t.Fatal("jitter should be off by default:", period)
+	}
+}
+
+func TestDisable0RTT(t *testing.T) {
+	serverAddr := serveTestTuic(t)
+	tlsConfig := &tls.Config{
+		NextProtos:         []string{"h3"},
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(8),
+	}
+	handshake := func(disable0RTT bool) HandshakeInfo {
+		d, err := NewClient(ClientConfig{
+			Server:      "127.0.0.1",
+			Port:        uint16(serverAddr.Port),
+			Uuid:        testUuid,
+			TlsConfig:   tlsConfig,
+			ReduceRtt:   true,
+			Disable0RTT: disable0RTT,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := d.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err = c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		// Wait for the session ticket with a round trip.
+		if _, err = c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(c, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+		var cli *clientImpl
+		for elem := d.clientRing.ring.Front(); elem != nil; elem = elem.Next() {
+			if node := elem.Value.(*clientRingNode); node.cli.quicConn != nil {
+				cli = node.cli
+			}
+		}
+		quicConn := cli.quicConn
+		if early, ok := quicConn.(quic.EarlyConnection); ok {
+			<-early.HandshakeComplete()
+		}
+		info, _ := cli.HandshakeInfo()
+		time.Sleep(10 * time.Millisecond)
+		_ = cli.Close()
+		return info
+	}
+	if info := handshake(false); info.Resumed || info.Used0RTT {
+		t.Fatal("the first handshake is resumed", info)
+	}
+	if info := handshake(false); !info.Used0RTT {
+		t.Fatal("0-RTT is not used", info)
+	}
+	if info := handshake(true); info.Used0RTT || info.RoundTrips != 1 {
+		t.Fatal("0-RTT is used when disabled", info)
+	}
+}
+
+func TestDialContextExpiresInAuth(t *testing.T) {
+	// The server grants no unidirectional streams, so the authentication
+	// stream can never be opened.
+	lis, err := quic.ListenAddrEarly("127.0.0.1:0", newTestTlsConfig(t), &quic.Config{EnableDatagrams: true, MaxIncomingUniStreams: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	accepted := make(chan quic.Connection, 1)
+	go func() {
+		conn, err := lis.Accept(context.Background())
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	nextDialer := &countingDialer{Dialer: direct.SymmetricDirect}
+	d, err := NewClient(ClientConfig{
+		NextDialer: nextDialer,
+		Server:     "127.0.0.1",
+		Port:       uint16(lis.Addr().(*net.UDPAddr).Port),
+		Uuid:       testUuid,
+		TlsConfig:  &tls.Config{NextProtos: []string{"h3"}, ServerName: "example.com", InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err = d.DialContext(ctx, "tcp", "example.com:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected the context error, got", err)
+	}
+	// The handshake completes, so the server sees the connection, which the
+	// client closes.
+	select {
+	case conn := <-accepted:
+		select {
+		case <-conn.Context().Done():
+		case <-time.After(3 * time.Second):
+			t.Fatal("the connection is not closed")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no connection")
+	}
+	// The connection is not kept for the next dial.
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err = d.DialContext(ctx, "tcp", "example.com:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected the context error, got", err)
+	}
+	if dials := atomic.LoadInt32(&nextDialer.dials); dials != 2 {
+		t.Fatal("unexpected dials", dials)
+	}
+}
+
+func TestMaxConnLifetime(t *testing.T) {
+	// Rotate on demand instead of after the lifetime.
+	afterFunc := lifetimeAfterFunc
+	defer func() { lifetimeAfterFunc = afterFunc }()
+	rotations := make(chan func(), 4)
+	lifetimeAfterFunc = func(d time.Duration, f func()) *time.Timer {
+		rotations <- f
+		timer := time.NewTimer(d)
+		timer.Stop()
+		return timer
+	}
+	serverAddr := serveTestTuic(t)
+	nextDialer := &countingDialer{Dialer: direct.SymmetricDirect}
+	d, err := NewClient(ClientConfig{
+		NextDialer:      nextDialer,
+		Server:          "127.0.0.1",
+		Port:            uint16(serverAddr.Port),
+		Uuid:            testUuid,
+		TlsConfig:       &tls.Config{NextProtos: []string{"h3"}, ServerName: "example.com", InsecureSkipVerify: true},
+		MaxConnLifetime: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := func(c netproxy.Conn, msg string) {
+		if err := c.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != msg {
+			t.Fatal(string(buf))
+		}
+	}
+	old, err := d.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	echo(old, "hello")
+	select {
+	case rotate := <-rotations:
+		rotate()
+	default:
+		t.Fatal("the rotation is not scheduled")
+	}
+	if dials := atomic.LoadInt32(&nextDialer.dials); dials != 2 {
+		t.Fatal("the connection is not rotated", dials)
+	}
+	// The stream keeps the retired connection open.
+	echo(old, "world")
+	c, err := d.Dial("tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echo(c, "hello")
+	// The new stream goes to the connection dialed by the rotation, whose own
+	// rotation is scheduled but not run.
+	if len(rotations) != 1 {
+		t.Fatal("the rotation of the new connection is not scheduled")
+	}
+	if dials := atomic.LoadInt32(&nextDialer.dials); dials != 2 {
+		t.Fatal("unexpected dials", dials)
+	}
+}
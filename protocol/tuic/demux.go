@@ -0,0 +1,283 @@
+package tuic
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+// demuxQueueSize is the number of packets a local conn of a Demux buffers
+// before dropping new ones.
+const demuxQueueSize = 64
+
+var errDemuxNoTarget = errors.New("demux conn has no target: use WriteTo")
+
+// Demux shares one UDP session among several local sockets, each of which is
+// identified by a caller-supplied local id. A reply is routed to the local
+// socket that last sent to its source, so targets should be IP addresses the
+// server replies from. Replies from other sources are dropped.
+//
+// Routes are per target, not per local id: if two local sockets send to the
+// same target, the replies go to whichever sent last, and the other misses
+// them. Such takeovers are counted by RouteConflicts, and callers needing both
+// should give each local socket a session of its own.
+type Demux struct {
+	dropped   uint64
+	conflicts uint64
+
+	pc netproxy.PacketConn
+
+	mu     sync.Mutex
+	conns  map[uint32]*demuxConn
+	routes map[string]*demuxConn
+	err    error
+
+	closeOnce sync.Once
+}
+
+type demuxPacket struct {
+	data []byte
+	addr netip.AddrPort
+}
+
+type demuxConn struct {
+	demux   *Demux
+	localId uint32
+	queue   chan demuxPacket
+	closed  chan struct{}
+
+	closeOnce sync.Once
+
+	muTimer           sync.Mutex
+	readDeadline      time.Time
+	readDeadlineTimer *time.Timer
+	readClosed        chan struct{}
+}
+
+// NewDemux returns a Demux over the session pc and starts reading from it.
+// Closing the Demux closes pc.
+func NewDemux(pc netproxy.PacketConn) *Demux {
+	d := &Demux{
+		pc:     pc,
+		conns:  make(map[uint32]*demuxConn),
+		routes: make(map[string]*demuxConn),
+	}
+	go d.run()
+	return d
+}
+
+// routeKey normalizes an IP address so that a reply matches the target it is
+// sent to. Other addresses are used as is.
+func routeKey(addr string) string {
+	if addrPort, err := netip.ParseAddrPort(addr); err == nil {
+		return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()).String()
+	}
+	return addr
+}
+
+func (d *Demux) run() {
+	buf := make([]byte, 0xffff)
+	for {
+		n, addr, err := d.pc.ReadFrom(buf)
+		if err != nil {
+			d.closeConns(err)
+			return
+		}
+		d.mu.Lock()
+		c := d.routes[routeKey(addr.String())]
+		d.mu.Unlock()
+		if c == nil {
+			atomic.AddUint64(&d.dropped, 1)
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		select {
+		case c.queue <- demuxPacket{data: data, addr: addr}:
+		default:
+			atomic.AddUint64(&d.dropped, 1)
+		}
+	}
+}
+
+// Conn returns the local conn of localId, creating it if it does not exist.
+// It returns net.ErrClosed if the Demux is closed.
+func (d *Demux) Conn(localId uint32) (netproxy.PacketConn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if c, ok := d.conns[localId]; ok {
+		return c, nil
+	}
+	c := &demuxConn{
+		demux:      d,
+		localId:    localId,
+		queue:      make(chan demuxPacket, demuxQueueSize),
+		closed:     make(chan struct{}),
+		readClosed: make(chan struct{}),
+	}
+	d.conns[localId] = c
+	return c, nil
+}
+
+// Dropped returns the number of replies dropped because no local conn could be
+// found or its queue was full.
+func (d *Demux) Dropped() uint64 {
+	return atomic.LoadUint64(&d.dropped)
+}
+
+// RouteConflicts returns the number of times a local conn took over the
+// replies of a target from another one by sending to it.
+func (d *Demux) RouteConflicts() uint64 {
+	return atomic.LoadUint64(&d.conflicts)
+}
+
+// Close closes the session and all local conns.
+func (d *Demux) Close() (err error) {
+	d.closeOnce.Do(func() {
+		err = d.pc.Close()
+		d.closeConns(net.ErrClosed)
+	})
+	return err
+}
+
+func (d *Demux) closeConns(err error) {
+	d.mu.Lock()
+	if d.err == nil {
+		d.err = err
+	}
+	conns := d.conns
+	d.conns = make(map[uint32]*demuxConn)
+	d.routes = make(map[string]*demuxConn)
+	d.mu.Unlock()
+	for _, c := range conns {
+		c.closeOnce.Do(func() { close(c.closed) })
+	}
+}
+
+func (d *Demux) remove(c *demuxConn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conns[c.localId] == c {
+		delete(d.conns, c.localId)
+	}
+	for key, routed := range d.routes {
+		if routed == c {
+			delete(d.routes, key)
+		}
+	}
+}
+
+func (d *Demux) closedError() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	return net.ErrClosed
+}
+
+func (c *demuxConn) Read(b []byte) (n int, err error) {
+	n, _, err = c.ReadFrom(b)
+	return n, err
+}
+
+func (c *demuxConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	// Prefer queued packets to the close of the Demux.
+	select {
+	case packet := <-c.queue:
+		return copy(p, packet.data), packet.addr, nil
+	default:
+	}
+	select {
+	case packet := <-c.queue:
+		return copy(p, packet.data), packet.addr, nil
+	case <-c.readDeadlineChan():
+		return 0, netip.AddrPort{}, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, netip.AddrPort{}, c.demux.closedError()
+	}
+}
+
+func (c *demuxConn) Write(b []byte) (n int, err error) {
+	return 0, errDemuxNoTarget
+}
+
+// WriteTo sends p to addr and routes the replies from addr to c.
+func (c *demuxConn) WriteTo(p []byte, addr string) (n int, err error) {
+	select {
+	case <-c.closed:
+		return 0, c.demux.closedError()
+	default:
+	}
+	c.demux.mu.Lock()
+	if c.demux.conns[c.localId] == c {
+		key := routeKey(addr)
+		if routed, ok := c.demux.routes[key]; ok && routed != c {
+			atomic.AddUint64(&c.demux.conflicts, 1)
+		}
+		c.demux.routes[key] = c
+	}
+	c.demux.mu.Unlock()
+	return c.demux.pc.WriteTo(p, addr)
+}
+
+// Close closes the local conn. The session is kept for other local conns.
+func (c *demuxConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	c.demux.remove(c)
+	return nil
+}
+
+func (c *demuxConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *demuxConn) SetReadDeadline(t time.Time) error {
+	c.muTimer.Lock()
+	defer c.muTimer.Unlock()
+	if c.readDeadlineTimer != nil {
+		c.readDeadlineTimer.Stop()
+		c.readDeadlineTimer = nil
+	}
+	if isClosedChan(c.readClosed) {
+		c.readClosed = make(chan struct{})
+	}
+	c.readDeadline = t
+	switch {
+	case t.IsZero():
+	case !t.After(time.Now()):
+		close(c.readClosed)
+	default:
+		c.readDeadlineTimer = time.AfterFunc(time.Until(t), func() {
+			c.muTimer.Lock()
+			defer c.muTimer.Unlock()
+			if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) && !isClosedChan(c.readClosed) {
+				close(c.readClosed)
+			}
+		})
+	}
+	return nil
+}
+
+// SetWriteDeadline is a no-op since the session is shared.
+func (c *demuxConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *demuxConn) readDeadlineChan() <-chan struct{} {
+	c.muTimer.Lock()
+	defer c.muTimer.Unlock()
+	return c.readClosed
+}
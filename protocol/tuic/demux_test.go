@@ -0,0 +1,110 @@
+package tuic
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+func newTestReply(source string, data string) *Packet {
+	return NewPacket(1, 0, 1, 0, uint16(len(data)), NewAddressAddrPort(netip.MustParseAddrPort(source)), []byte(data), Ver5)
+}
+
+func TestDemux(t *testing.T) {
+	quicConn := &fakeQuicConn{}
+	pc := newTestPacketConn(quicConn)
+	demux := NewDemux(pc)
+	defer demux.Close()
+	targets := map[uint32]string{1: "1.1.1.1:53", 2: "8.8.8.8:53"}
+	for localId, target := range targets {
+		c, err := demux.Conn(localId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.WriteTo([]byte("query"), target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Both local conns share the session.
+	if len(quicConn.messages) != 2 {
+		t.Fatal("unexpected sends", len(quicConn.messages))
+	}
+	pc.incomingPackets.PushBack(newTestReply("9.9.9.9:53", "unknown"))
+	pc.incomingPackets.PushBack(newTestReply("8.8.8.8:53", "reply 2"))
+	pc.incomingPackets.PushBack(newTestReply("1.1.1.1:53", "reply 1"))
+
+	for localId, target := range targets {
+		c, err := demux.Conn(localId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 32)
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != target || string(buf[:n]) != "reply "+string(rune('0'+localId)) {
+			t.Fatal("misrouted reply", localId, addr, string(buf[:n]))
+		}
+	}
+	if demux.Dropped() != 1 {
+		t.Fatal("the reply of an unknown source is not dropped", demux.Dropped())
+	}
+
+	// A closed local conn no longer receives replies.
+	c, _ := demux.Conn(1)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pc.incomingPackets.PushBack(newTestReply("1.1.1.1:53", "late"))
+	c2, _ := demux.Conn(2)
+	if err := c2.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c2.ReadFrom(make([]byte, 32)); err == nil {
+		t.Fatal("expected deadline exceeded")
+	}
+	if demux.Dropped() != 2 {
+		t.Fatal("unexpected drops", demux.Dropped())
+	}
+
+	if err := demux.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c2.ReadFrom(make([]byte, 32)); err == nil {
+		t.Fatal("expected close error")
+	}
+	if _, err := demux.Conn(3); err == nil {
+		t.Fatal("expected close error")
+	}
+}
+
+func TestDemuxRouteConflict(t *testing.T) {
+	pc := newTestPacketConn(&fakeQuicConn{})
+	demux := NewDemux(pc)
+	defer demux.Close()
+	c1, _ := demux.Conn(1)
+	c2, _ := demux.Conn(2)
+	for _, c := range []netproxy.PacketConn{c1, c1, c2} {
+		if _, err := c.WriteTo([]byte("query"), "1.1.1.1:53"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conflicts := demux.RouteConflicts(); conflicts != 1 {
+		t.Fatal("unexpected conflicts", conflicts)
+	}
+	// The last sender takes the replies.
+	pc.incomingPackets.PushBack(newTestReply("1.1.1.1:53", "reply"))
+	if err := c2.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 32)
+	if n, _, err := c2.ReadFrom(buf); err != nil || string(buf[:n]) != "reply" {
+		t.Fatal("unexpected reply", string(buf[:n]), err)
+	}
+}
@@ -2,14 +2,16 @@ package tuic
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"strconv"
 	"time"
 
 	"github.com/daeuniverse/softwind/netproxy"
 	"github.com/daeuniverse/softwind/protocol"
 	"github.com/daeuniverse/softwind/protocol/tuic/common"
-	"github.com/google/uuid"
 	"github.com/mzz2017/quic-go"
 )
 
@@ -23,56 +25,54 @@ type Dialer struct {
 	proxyAddress string
 	nextDialer   netproxy.Dialer
 	metadata     protocol.Metadata
+	udpBind      string
+	// sessionLimiter limits the creation of UDP sessions if it is not nil.
+	sessionLimiter      *tokenBucket
+	blockOnSessionLimit bool
+	// onHandshakeBytes receives the handshake datagrams if it is not nil.
+	onHandshakeBytes func(hexBytes string)
+	// connectionIdLength is the length of connection IDs. 0 means the default.
+	connectionIdLength int
 }
 
+// ErrSessionRateLimited is returned if a UDP session is not created for
+// exceeding ClientConfig.SessionsPerSec.
+var ErrSessionRateLimited = errors.New("session creation rate limited")
+
 func NewDialer(nextDialer netproxy.Dialer, header protocol.Header) (netproxy.Dialer, error) {
-	metadata := protocol.Metadata{
-		IsClient: header.IsClient,
+	config, err := configFromHeader(nextDialer, header)
+	if err != nil {
+		return nil, err
 	}
+	return newDialer(config, header.IsClient)
+}
 
-	id, err := uuid.Parse(header.User)
+// intParam parses the integer param name in range [min, max]. It returns 0 if
+// the param is not given.
+func intParam(header protocol.Header, name string, min int, max int) (int, error) {
+	v := header.Params.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(v)
 	if err != nil {
-		return nil, fmt.Errorf("parse UUID: %w", err)
+		return 0, fmt.Errorf("parse %v: %w", name, err)
 	}
-	// ensure server's incoming stream can handle correctly, increase to 1.1x
-	maxDatagramFrameSize := 1400
-	udpRelayMode := common.NATIVE
-	if header.Flags&protocol.Flags_Tuic_UdpRelayModeQuic > 0 {
-		// FIXME: QUIC has severe performance problems.
-		// udpRelayMode = common.QUIC
+	if i < min || i > max {
+		return 0, fmt.Errorf("bad %v: should be in range [%v, %v]", name, min, max)
 	}
-	return &Dialer{
-		clientRing: newClientRing(func(capabilityCallback func(n int64)) *clientImpl {
-			return &clientImpl{
-				ClientOption: &ClientOption{
-					TlsConfig: header.TlsConfig,
-					QuicConfig: &quic.Config{
-						InitialStreamReceiveWindow:     common.InitialStreamReceiveWindow,
-						MaxStreamReceiveWindow:         common.MaxStreamReceiveWindow,
-						InitialConnectionReceiveWindow: common.InitialConnectionReceiveWindow,
-						MaxConnectionReceiveWindow:     common.MaxConnectionReceiveWindow,
-						KeepAlivePeriod:                3 * time.Second,
-						DisablePathMTUDiscovery:        false,
-						MaxDatagramFrameSize:           int64(maxDatagramFrameSize + PacketOverHead),
-						EnableDatagrams:                true,
-						HandshakeIdleTimeout:           8 * time.Second,
-						CapabilityCallback:             capabilityCallback,
-					},
-					Uuid:                  id,
-					Password:              header.Password,
-					UdpRelayMode:          udpRelayMode,
-					CongestionController:  header.Feature1,
-					ReduceRtt:             false,
-					CWND:                  10,
-					MaxUdpRelayPacketSize: maxDatagramFrameSize,
-				},
-				udp: true,
-			}
-		}, 10),
-		proxyAddress: header.ProxyAddress,
-		nextDialer:   nextDialer,
-		metadata:     metadata,
-	}, nil
+	return i, nil
+}
+
+// Sessions returns a snapshot of active UDP sessions of all connections.
+func (d *Dialer) Sessions() []SessionInfo {
+	return d.clientRing.Sessions()
+}
+
+// InboundDropped returns the number of incoming packets dropped by the inbound
+// limits of current connections.
+func (d *Dialer) InboundDropped() uint64 {
+	return d.clientRing.InboundDropped()
 }
 
 func (d *Dialer) DialTcp(addr string) (c netproxy.Conn, err error) {
@@ -87,18 +87,70 @@ func (d *Dialer) DialUdp(addr string) (c netproxy.PacketConn, err error) {
 	return pktConn.(netproxy.PacketConn), nil
 }
 
+// allowSession takes a token of sessionLimiter for a new UDP session.
+func (d *Dialer) allowSession(ctx context.Context) error {
+	if d.sessionLimiter == nil {
+		return nil
+	}
+	if d.blockOnSessionLimit {
+		return d.sessionLimiter.Wait(ctx, 1)
+	}
+	if !d.sessionLimiter.Allow(1, time.Now()) {
+		return ErrSessionRateLimited
+	}
+	return nil
+}
+
+// bindArgs returns the network and the server address to dial the UDP conn to
+// the server with, following udpBind.
+func (d *Dialer) bindArgs(udpNetwork string, rAddr net.Addr) (network string, serverAddress string, err error) {
+	if d.udpBind == "" {
+		return udpNetwork, d.proxyAddress, nil
+	}
+	magicNetwork, err := netproxy.ParseMagicNetwork(udpNetwork)
+	if err != nil {
+		return "", "", err
+	}
+	serverAddress = d.proxyAddress
+	switch d.udpBind {
+	case UdpBindV4:
+		magicNetwork.Network = "udp4"
+	case UdpBindV6:
+		magicNetwork.Network = "udp6"
+	case UdpBindDual:
+		// An IPv4 server is reached through its IPv4-mapped address.
+		magicNetwork.Network = "udp6"
+		addrPort := rAddr.(*net.UDPAddr).AddrPort()
+		serverAddress = netip.AddrPortFrom(netip.AddrFrom16(addrPort.Addr().As16()), addrPort.Port()).String()
+	}
+	return magicNetwork.Encode(), serverAddress, nil
+}
+
 func (d *Dialer) dialFuncFactory(udpNetwork string, rAddr net.Addr) common.DialFunc {
 	return func(ctx context.Context, dialer netproxy.Dialer) (transport *quic.Transport, addr net.Addr, err error) {
-		conn, err := dialer.Dial(udpNetwork, d.proxyAddress)
+		network, serverAddress, err := d.bindArgs(udpNetwork, rAddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		var conn netproxy.Conn
+		if contextDialer, ok := dialer.(netproxy.ContextDialer); ok {
+			conn, err = contextDialer.DialContext(ctx, network, serverAddress)
+		} else {
+			conn, err = netproxy.DialContext(ctx, network, serverAddress, dialer.Dial)
+		}
 		if err != nil {
 			return nil, nil, err
 		}
+		packetConn := conn.(netproxy.PacketConn)
+		if d.onHandshakeBytes != nil {
+			packetConn = &handshakeLogConn{PacketConn: packetConn, onHandshakeBytes: d.onHandshakeBytes}
+		}
 		pc := &netproxy.FakeNetPacketConn{
-			PacketConn: conn.(netproxy.PacketConn),
+			PacketConn: packetConn,
 			LAddr:      net.UDPAddrFromAddrPort(common.GetUniqueFakeAddrPort()),
 			RAddr:      rAddr,
 		}
-		transport = &quic.Transport{Conn: pc}
+		transport = &quic.Transport{Conn: pc, ConnectionIDLength: d.connectionIdLength}
 		transport.SetCreatedConn(true)
 		transport.SetSingleUse(true)
 		return transport, rAddr, nil
@@ -106,6 +158,21 @@ func (d *Dialer) dialFuncFactory(udpNetwork string, rAddr net.Addr) common.DialF
 }
 
 func (d *Dialer) Dial(network string, addr string) (c netproxy.Conn, err error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// Capabilities reports that the Dialer relays TCP and UDP and dials with a
+// context.
+func (d *Dialer) Capabilities() netproxy.Capabilities {
+	return netproxy.CapabilityTcp | netproxy.CapabilityUdp | netproxy.CapabilityContext
+}
+
+// DialContext dials addr through the server. If a new connection to the
+// server is needed, ctx bounds its dial, handshake and authentication as a
+// whole, and ctx.Err() is returned once it is done during any of them. With
+// ReduceRtt, the authentication is not waited for. The phases of the new
+// connection are reported to the netproxy.DialTrace carried by ctx.
+func (d *Dialer) DialContext(ctx context.Context, network string, addr string) (c netproxy.Conn, err error) {
 	magicNetwork, err := netproxy.ParseMagicNetwork(network)
 	if err != nil {
 		return nil, err
@@ -127,7 +194,7 @@ func (d *Dialer) Dial(network string, addr string) (c netproxy.Conn, err error)
 				Network: "udp",
 				Mark:    magicNetwork.Mark,
 			}.Encode()
-			tcpConn, err := d.clientRing.DialContextWithDialer(context.TODO(), &mdata, d.nextDialer,
+			tcpConn, err := d.clientRing.DialContextWithDialer(ctx, &mdata, d.nextDialer,
 				d.dialFuncFactory(udpNetwork, proxyAddr),
 			)
 			if err != nil {
@@ -135,13 +202,15 @@ func (d *Dialer) Dial(network string, addr string) (c netproxy.Conn, err error)
 			}
 			return tcpConn, nil
 		} else {
-			udpConn, err := d.clientRing.ListenPacketWithDialer(context.TODO(), &mdata, d.nextDialer,
+			if err = d.allowSession(ctx); err != nil {
+				return nil, err
+			}
+			udpConn, err := d.clientRing.ListenPacketWithDialer(ctx, &mdata, d.nextDialer,
 				d.dialFuncFactory(udpNetwork, proxyAddr),
 			)
 			if err != nil {
 				return nil, err
 			}
-			udpConn.(*quicStreamPacketConn).target = addr
 			return udpConn, nil
 		}
 
@@ -0,0 +1,108 @@
+package tuic
+
+import (
+	"crypto/tls"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/protocol"
+	"github.com/daeuniverse/softwind/protocol/direct"
+	"github.com/daeuniverse/softwind/protocol/tuic/common"
+)
+
+func newTestDialer(t *testing.T, header protocol.Header) *Dialer {
+	header.ProxyAddress = "127.0.0.1:443"
+	header.User = "00000000-0000-0000-0000-000000000000"
+	header.IsClient = true
+	if header.TlsConfig == nil {
+		header.TlsConfig = &tls.Config{NextProtos: []string{"h3"}, ServerName: "example.com"}
+	}
+	d, err := NewDialer(direct.SymmetricDirect, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.(*Dialer)
+}
+
+func TestGreaseAlpn(t *testing.T) {
+	hasGrease := func(nextProtos []string) bool {
+		for _, proto := range nextProtos {
+			if common.IsGreaseAlpn(proto) {
+				return true
+			}
+		}
+		return false
+	}
+	d := newTestDialer(t, protocol.Header{})
+	if hasGrease(d.clientRing.newClient(nil).tlsConfig().NextProtos) {
+		t.Fatal("GREASE should be off by default")
+	}
+	tlsConfig := &tls.Config{NextProtos: []string{"h3"}, ServerName: "example.com"}
+	d = newTestDialer(t, protocol.Header{TlsConfig: tlsConfig, Params: url.Values{"greaseAlpn": []string{"true"}}})
+	cli := d.clientRing.newClient(nil)
+	// Each connection draws its own value.
+	drawn := make(map[string]bool)
+	for i := 0; i < 64; i++ {
+		nextProtos := cli.tlsConfig().NextProtos
+		if !hasGrease(nextProtos) || len(nextProtos) != 2 {
+			t.Fatal("GREASE is not injected:", nextProtos)
+		}
+		drawn[strings.Join(nextProtos, ",")] = true
+	}
+	if len(drawn) == 1 {
+		t.Fatal("GREASE is drawn once for all connections")
+	}
+	if len(tlsConfig.NextProtos) != 1 {
+		t.Fatal("the given TLS config is modified")
+	}
+}
+
+func TestConfigFromHeader(t *testing.T) {
+	header := protocol.Header{
+		ProxyAddress: "[2001:db8::1]:8443",
+		User:         "00000000-0000-0000-0000-000000000000",
+		Password:     "password",
+		Feature1:     "cubic",
+		TlsConfig:    &tls.Config{NextProtos: []string{"h3"}},
+		Params:       url.Values{"pktId": []string{"sequential"}, "padMultiple": []string{"64"}, "sessionsPerSec": []string{"5"}, "blockOnSessionLimit": []string{"true"}, "udpBind": []string{"v4"}, "writeTimeout": []string{"2s"}, "maxConnLifetime": []string{"1h"}, "connectionIdLength": []string{"8"}, "reorderWindow": []string{"16"}, "qlog": []string{"true"}, "qlogDir": []string{"/tmp"}, "reduceRtt": []string{"true"}, "handshakeCongestion": []string{"new_reno"}},
+	}
+	config, err := configFromHeader(direct.SymmetricDirect, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Server != "2001:db8::1" || config.Port != 8443 || config.CongestionController != "cubic" ||
+		config.UdpRelayMode != UdpRelayModeNative || !config.SequentialPktId || config.PadMultiple != 64 ||
+		config.SessionsPerSec != 5 || !config.BlockOnSessionLimit || config.UdpBind != UdpBindV4 ||
+		config.DefaultWriteTimeout != 2*time.Second || config.MaxConnLifetime != time.Hour || config.ConnectionIdLength != 8 || config.ReorderWindow != 16 ||
+		!config.Qlog || config.QlogDir != "/tmp" || !config.ReduceRtt || config.HandshakeCongestion != "new_reno" {
+		t.Fatal("unexpected config", config)
+	}
+	if err = config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	header.Params.Set("pktId", "counter")
+	if _, err = configFromHeader(direct.SymmetricDirect, header); err == nil {
+		t.Fatal("an unknown PKT_ID allocation is accepted")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	var d netproxy.Dialer = newTestDialer(t, protocol.Header{})
+	capabilities := netproxy.DialerCapabilities(d)
+	if !capabilities.Has(netproxy.CapabilityTcp | netproxy.CapabilityUdp | netproxy.CapabilityContext) {
+		t.Fatal("unexpected capabilities", capabilities)
+	}
+	if capabilities.Has(netproxy.CapabilityMigration) {
+		t.Fatal("migration is not supported")
+	}
+	if _, ok := d.(netproxy.ContextDialer); !ok {
+		t.Fatal("the context capability is reported without DialContext")
+	}
+	// Dialers are assumed to dial TCP only by default.
+	if capabilities := netproxy.DialerCapabilities(&countingDialer{}); capabilities != netproxy.CapabilityTcp {
+		t.Fatal("unexpected default capabilities", capabilities)
+	}
+}
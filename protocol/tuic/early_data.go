@@ -0,0 +1,44 @@
+//go:build go1.21
+
+package tuic
+
+import "crypto/tls"
+
+// noEarlyDataCache is a tls.ClientSessionCache that resumes sessions of the
+// wrapped cache without offering early data.
+type noEarlyDataCache struct {
+	wrapped tls.ClientSessionCache
+}
+
+func (c noEarlyDataCache) Put(key string, cs *tls.ClientSessionState) {
+	c.wrapped.Put(key, cs)
+}
+
+func (c noEarlyDataCache) Get(key string) (*tls.ClientSessionState, bool) {
+	cs, ok := c.wrapped.Get(key)
+	if !ok || cs == nil {
+		return cs, ok
+	}
+	ticket, state, err := cs.ResumptionState()
+	if err != nil || state == nil || !state.EarlyData {
+		return cs, ok
+	}
+	// The state is shared with other users of the wrapped cache.
+	s := *state
+	s.EarlyData = false
+	session, err := tls.NewResumptionState(ticket, &s)
+	if err != nil {
+		return nil, false
+	}
+	return session, true
+}
+
+// withoutEarlyData returns a copy of tlsConfig that never offers 0-RTT data.
+func withoutEarlyData(tlsConfig *tls.Config) *tls.Config {
+	if tlsConfig.ClientSessionCache == nil {
+		return tlsConfig
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ClientSessionCache = noEarlyDataCache{wrapped: tlsConfig.ClientSessionCache}
+	return tlsConfig
+}
@@ -0,0 +1,17 @@
+//go:build !go1.21
+
+package tuic
+
+import "crypto/tls"
+
+// withoutEarlyData returns a copy of tlsConfig that never offers 0-RTT data.
+// Sessions are not resumed at all because the session state cannot be changed
+// before Go 1.21.
+func withoutEarlyData(tlsConfig *tls.Config) *tls.Config {
+	if tlsConfig.ClientSessionCache == nil {
+		return tlsConfig
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ClientSessionCache = nil
+	return tlsConfig
+}
@@ -2,20 +2,47 @@ package tuic
 
 import (
 	"bytes"
+	"context"
 	"net/netip"
+	"sync"
+	"time"
 
 	"github.com/mzz2017/quic-go"
 )
 
-func fragWriteNative(quicConn quic.Connection, packet *Packet, buf *bytes.Buffer, fragSize int) (err error) {
+// FragmentSize returns the largest payload of a fragment carrying the address
+// that fits in maxDatagramSize once encoded. Use an address of AtypNone for
+// fragments other than the first one.
+func FragmentSize(maxDatagramSize int, address *Address) int {
+	size := maxDatagramSize - NewCommandHead(PacketType, Ver5).BytesLen() - packetFieldsLen - address.BytesLen()
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// fragWriteNative sends the packet in fragments, each of which is encoded by
+// codec into at most maxDatagramSize bytes. It returns the number of fragments
+// sent, which the peer holds under PKT_ID even if it fails.
+func fragWriteNative(quicConn quic.Connection, codec PacketCodec, packet *Packet, buf *bytes.Buffer, maxDatagramSize int, padMultiple int) (sent int, err error) {
+	// Work on a copy so that the caller can re-fragment packet on failure.
+	copied := *packet
+	packet = &copied
 	fullPayload := packet.DATA
 	off := 0
 	fragID := uint8(0)
-	if fragSize == 0 {
-		fragSize = 1
+	// Only the first fragment carries the address, so the others hold more.
+	firstSize := FragmentSize(maxDatagramSize, packet.ADDR)
+	restSize := FragmentSize(maxDatagramSize, &Address{TYPE: AtypNone})
+	fragCount := 1
+	if len(fullPayload) > firstSize {
+		fragCount += (len(fullPayload) - firstSize + restSize - 1) / restSize // round up
 	}
-	fragCount := uint8((len(fullPayload) + fragSize - 1) / fragSize) // round up
-	packet.FRAG_TOTAL = fragCount
+	if fragCount > 0xff {
+		return 0, quic.ErrMessageTooLarge(maxDatagramSize)
+	}
+	packet.FRAG_TOTAL = uint8(fragCount)
+	fragSize := firstSize
 	for off < len(fullPayload) {
 		payloadSize := len(fullPayload) - off
 		if payloadSize > fragSize {
@@ -28,54 +55,366 @@ func fragWriteNative(quicConn quic.Connection, packet *Packet, buf *bytes.Buffer
 		off += payloadSize
 		fragID++
 		buf.Reset()
-		err = frag.WriteTo(buf)
+		err = codec.Encode(buf, frag)
 		if err != nil {
 			return
 		}
+		padDatagram(buf, padMultiple, maxDatagramSize)
 		data := buf.Bytes()
 		err = quicConn.SendMessage(data)
 		if err != nil {
 			return
 		}
-		packet.ADDR.TYPE = AtypNone // avoid "fragment 2/2: address in non-first fragment"
+		sent++
+		packet.ADDR = &Address{TYPE: AtypNone} // avoid "fragment 2/2: address in non-first fragment"
+		fragSize = restSize
 	}
 	return
 }
 
-type deFragger struct {
-	pkgID uint16
-	frags []*Packet
-	count uint8
+// padDatagram pads the encoded packet in buf with zeros up to the next multiple
+// of padMultiple, but not beyond limit. The receiver only reads SIZE bytes of
+// data, so the padding is ignored.
+func padDatagram(buf *bytes.Buffer, padMultiple int, limit int) {
+	if padMultiple <= 1 {
+		return
+	}
+	padded := (buf.Len() + padMultiple - 1) / padMultiple * padMultiple
+	if padded > limit {
+		padded = limit
+	}
+	for buf.Len() < padded {
+		_ = buf.WriteByte(0)
+	}
 }
 
-func (d *deFragger) Feed(m *Packet, p []byte) (n int, addrPort netip.AddrPort, assembled bool) {
+// DeFragger reassembles the fragmented packets of one or more sessions, told
+// apart by their ASSOC_ID. The zero value is ready to use with the defaults,
+// and it is safe for concurrent use.
+type DeFragger struct {
+	// Timeout is how long fragments of a packet are kept. It is
+	// ReassemblyTimeout if 0.
+	Timeout time.Duration
+	// MaxPackets is the max number of packets being reassembled, beyond which
+	// the oldest ones are dropped. It is MaxReassemblingPackets if 0.
+	MaxPackets int
+	// MaxPacketsPerConn is the max number of packets of one ASSOC_ID being
+	// reassembled, beyond which the oldest ones of the ASSOC_ID are dropped,
+	// so that one session cannot take up all of MaxPackets. It is meant for
+	// callers feeding several sessions to one DeFragger: the packet conns of
+	// a client each have their own. 0 means no limit other than MaxPackets.
+	MaxPacketsPerConn int
+	// ReorderWindow is the max gap between the lowest missing fragment of a
+	// packet and the highest fragment held, beyond which the fragments of the
+	// packet are dropped as lost. 0 means no limit.
+	ReorderWindow int
+	// OnDrop is called when fragments of a packet are dropped before
+	// reassembly. It is called with the DeFragger locked, so it must not call
+	// back into it. It may be nil.
+	OnDrop func(pktId uint16, fragments int, reason FragmentDropReason)
+
+	mu        sync.Mutex
+	packets   map[fragKey]*fragBuffer
+	dropped   uint64
+	lastSweep time.Time
+	// drained is closed once there is no packet being reassembled.
+	drained chan struct{}
+	// conns counts the packets in packets by ASSOC_ID.
+	conns map[uint16]int
+}
+
+// DeFraggerStats is a snapshot of a DeFragger.
+type DeFraggerStats struct {
+	// Reassembling is the number of packets being reassembled.
+	Reassembling int
+	// Buffered is the number of fragments waiting for reassembly.
+	Buffered int
+	// Dropped is the number of fragments dropped so far.
+	Dropped uint64
+}
+
+func (d *DeFragger) timeout() time.Duration {
+	if d.Timeout <= 0 {
+		return ReassemblyTimeout
+	}
+	return d.Timeout
+}
+
+func (d *DeFragger) maxPackets() int {
+	if d.MaxPackets <= 0 {
+		return MaxReassemblingPackets
+	}
+	return d.MaxPackets
+}
+
+// Feed feeds a fragment into the DeFragger. Once all fragments of its packet
+// have arrived, the packet is copied into p and assembled is true. The span
+// is the time between the arrivals of the first and the last fragment. Invalid
+// fragments are ignored. Packets not reassembled in time, and the oldest ones
+// beyond MaxPackets or MaxPacketsPerConn, are dropped as fragments are fed.
+func (d *DeFragger) Feed(m *Packet, p []byte) (n int, addrPort netip.AddrPort, span time.Duration, assembled bool) {
 	if m.FRAG_TOTAL <= 1 {
-		return copy(p, m.DATA), m.ADDR.UDPAddr().AddrPort(), true
+		return copy(p, m.DATA), m.ADDR.UDPAddr().AddrPort(), 0, true
+	}
+	now := m.receivedAt
+	if now.IsZero() {
+		now = time.Now()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.packets == nil {
+		d.packets = make(map[fragKey]*fragBuffer)
+		d.conns = make(map[uint16]int)
+	}
+	key := fragKey{connId: m.ASSOC_ID, pktId: m.PKT_ID}
+	b, ok := d.packets[key]
+	if !ok {
+		b = &fragBuffer{}
+		d.packets[key] = b
+		d.conns[key.connId]++
+	}
+	if n, addrPort, span, assembled = b.Feed(m, p, now); assembled {
+		d.delete(key)
+		return
+	}
+	if b.buffered() == 0 {
+		// The fragment is rejected.
+		d.delete(key)
+	} else if d.ReorderWindow > 0 && b.gap() > d.ReorderWindow {
+		d.drop(key, b, FragmentDropReorder)
+	} else if !ok {
+		d.limitConn(key.connId)
+	}
+	d.evict(now)
+	return
+}
+
+// limitConn drops the oldest packets of connId beyond MaxPacketsPerConn.
+func (d *DeFragger) limitConn(connId uint16) {
+	if d.MaxPacketsPerConn <= 0 {
+		return
+	}
+	for d.conns[connId] > d.MaxPacketsPerConn {
+		var oldestKey fragKey
+		var oldest *fragBuffer
+		for key, b := range d.packets {
+			if key.connId == connId && (oldest == nil || b.first.Before(oldest.first)) {
+				oldestKey, oldest = key, b
+			}
+		}
+		d.drop(oldestKey, oldest, FragmentDropConnCount)
+	}
+}
+
+// Flush returns once every packet being reassembled is either completed by
+// Feed or dropped after Timeout, or ctx is done.
+func (d *DeFragger) Flush(ctx context.Context) error {
+	for {
+		d.mu.Lock()
+		if len(d.packets) == 0 {
+			d.mu.Unlock()
+			return nil
+		}
+		oldest := d.sweep(time.Now())
+		if len(d.packets) == 0 {
+			d.mu.Unlock()
+			return nil
+		}
+		if d.drained == nil {
+			d.drained = make(chan struct{})
+		}
+		drained := d.drained
+		expiry := oldest.first.Add(d.timeout())
+		d.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(expiry))
+		select {
+		case <-drained:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Stats returns a snapshot of the DeFragger.
+func (d *DeFragger) Stats() DeFraggerStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := DeFraggerStats{
+		Reassembling: len(d.packets),
+		Dropped:      d.dropped,
 	}
-	if m.FRAG_ID >= m.FRAG_TOTAL {
+	for _, b := range d.packets {
+		stats.Buffered += b.buffered()
+	}
+	return stats
+}
+
+// evict drops packets not reassembled in time, and the oldest ones beyond
+// MaxPackets. It sweeps at most every half Timeout unless there are too many
+// packets.
+func (d *DeFragger) evict(now time.Time) {
+	if len(d.packets) <= d.maxPackets() && now.Sub(d.lastSweep) < d.timeout()/2 {
+		return
+	}
+	d.sweep(now)
+}
+
+// sweep does the eviction of evict and returns the oldest packet left, if any.
+func (d *DeFragger) sweep(now time.Time) (oldest *fragBuffer) {
+	d.lastSweep = now
+	timeout := d.timeout()
+	var oldestKey fragKey
+	for key, b := range d.packets {
+		if b.buffered() > 0 && now.Sub(b.first) >= timeout {
+			d.drop(key, b, FragmentDropAge)
+			continue
+		}
+		if oldest == nil || b.first.Before(oldest.first) {
+			oldestKey, oldest = key, b
+		}
+	}
+	for len(d.packets) > d.maxPackets() && oldest != nil {
+		d.drop(oldestKey, oldest, FragmentDropCount)
+		oldest = nil
+		for key, b := range d.packets {
+			if oldest == nil || b.first.Before(oldest.first) {
+				oldestKey, oldest = key, b
+			}
+		}
+	}
+	return oldest
+}
+
+func (d *DeFragger) delete(key fragKey) {
+	if _, ok := d.packets[key]; !ok {
+		return
+	}
+	delete(d.packets, key)
+	if d.conns[key.connId]--; d.conns[key.connId] == 0 {
+		delete(d.conns, key.connId)
+	}
+	if len(d.packets) == 0 && d.drained != nil {
+		close(d.drained)
+		d.drained = nil
+	}
+}
+
+func (d *DeFragger) drop(key fragKey, b *fragBuffer, reason FragmentDropReason) {
+	d.delete(key)
+	fragments := b.buffered()
+	d.dropped += uint64(fragments)
+	if d.OnDrop != nil {
+		d.OnDrop(key.pktId, fragments, reason)
+	}
+}
+
+// fragKey identifies a packet being reassembled.
+type fragKey struct {
+	connId uint16
+	pktId  uint16
+}
+
+// fragBuffer holds the fragments of one packet.
+type fragBuffer struct {
+	frags []*Packet
+	count uint8
+	// first is the arrival time of the first fragment.
+	first time.Time
+}
+
+// Feed feeds a fragment arriving at now into the fragBuffer.
+func (b *fragBuffer) Feed(m *Packet, p []byte, now time.Time) (n int, addrPort netip.AddrPort, span time.Duration, assembled bool) {
+	if m.FRAG_ID >= m.FRAG_TOTAL || (b.count > 0 && int(m.FRAG_TOTAL) != len(b.frags)) {
 		// wtf is this?
 		return
 	}
-	if d.count == 0 {
+	if b.count == 0 {
 		// new message, clear previous state
-		d.pkgID = m.PKT_ID
-		d.frags = make([]*Packet, m.FRAG_TOTAL)
-		d.count = 1
-		d.frags[m.FRAG_ID] = m
-	} else if d.frags[m.FRAG_ID] == nil {
-		d.frags[m.FRAG_ID] = m
-		d.count++
-		if int(d.count) == len(d.frags) {
+		b.frags = make([]*Packet, m.FRAG_TOTAL)
+		b.count = 1
+		b.frags[m.FRAG_ID] = m
+		b.first = now
+	} else if b.frags[m.FRAG_ID] == nil {
+		b.frags[m.FRAG_ID] = m
+		b.count++
+		if int(b.count) == len(b.frags) {
 			// all fragments received, assemble
-			for _, frag := range d.frags {
+			for _, frag := range b.frags {
 				if n >= len(p) {
 					break
 				}
 				n += copy(p[n:], frag.DATA)
 			}
-			d.count = 0
-			return n, d.frags[0].ADDR.UDPAddr().AddrPort(), true
+			b.count = 0
+			return n, b.frags[0].ADDR.UDPAddr().AddrPort(), now.Sub(b.first), true
 		}
 	}
 	return
 }
+
+// gap returns the distance from the lowest missing fragment to the highest
+// fragment held.
+func (b *fragBuffer) gap() int {
+	lowestMissing, highest := -1, 0
+	for i, frag := range b.frags {
+		if frag == nil {
+			if lowestMissing < 0 {
+				lowestMissing = i
+			}
+		} else {
+			highest = i
+		}
+	}
+	if lowestMissing < 0 || highest < lowestMissing {
+		return 0
+	}
+	return highest - lowestMissing
+}
+
+// buffered returns the number of fragments waiting for reassembly.
+func (b *fragBuffer) buffered() int {
+	return int(b.count)
+}
+
+// FragmentDropReason tells why buffered fragments are dropped.
+type FragmentDropReason int
+
+const (
+	// FragmentDropAge means the packet is not reassembled in time.
+	FragmentDropAge FragmentDropReason = iota
+	// FragmentDropCount means too many packets are being reassembled.
+	FragmentDropCount
+	// FragmentDropReorder means fragments arrive too far out of order.
+	FragmentDropReorder
+	// FragmentDropConnCount means too many packets of the session are being
+	// reassembled.
+	FragmentDropConnCount
+)
+
+func (r FragmentDropReason) String() string {
+	switch r {
+	case FragmentDropAge:
+		return "age"
+	case FragmentDropCount:
+		return "count"
+	case FragmentDropReorder:
+		return "reorder"
+	case FragmentDropConnCount:
+		return "conn count"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// ReassemblyTimeout is how long a DeFragger keeps fragments of a packet.
+	ReassemblyTimeout = 10 * time.Second
+	// MaxReassemblingPackets is the max number of packets being reassembled
+	// by a DeFragger.
+	MaxReassemblingPackets = 64
+)
@@ -0,0 +1,462 @@
+package tuic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestFragments(pktId uint16, data []byte, fragSize int) []*Packet {
+	address := NewAddressAddrPort(netip.MustParseAddrPort("127.0.0.1:53"))
+	fragTotal := uint8((len(data) + fragSize - 1) / fragSize)
+	var frags []*Packet
+	for i := 0; i < int(fragTotal); i++ {
+		end := (i + 1) * fragSize
+		if end > len(data) {
+			end = len(data)
+		}
+		addr := address
+		if i > 0 {
+			addr = &Address{TYPE: AtypNone}
+		}
+		chunk := data[i*fragSize : end]
+		frags = append(frags, NewPacket(1, pktId, fragTotal, uint8(i), uint16(len(chunk)), addr, chunk, Ver5))
+	}
+	return frags
+}
+
+func TestReassemblyTime(t *testing.T) {
+	pc := newTestPacketConn(&fakeQuicConn{})
+	frags := newTestFragments(7, []byte("hello, world"), 4)
+	const delay = 20 * time.Millisecond
+	go func() {
+		for _, frag := range frags {
+			pc.incomingPackets.PushBack(frag)
+			time.Sleep(delay)
+		}
+	}()
+	buf := make([]byte, 64)
+	n, addr, meta, err := pc.ReadFromEx(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello, world" || addr.String() != "127.0.0.1:53" {
+		t.Fatal(string(buf[:n]), addr)
+	}
+	// Three fragments are two delays apart.
+	if meta.ReassemblyTime < 2*delay || meta.ReassemblyTime > time.Second {
+		t.Fatal("implausible reassembly time", meta.ReassemblyTime)
+	}
+
+	pc.incomingPackets.PushBack(newTestFragments(8, []byte("short"), 16)[0])
+	_, _, meta, err = pc.ReadFromEx(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.ReassemblyTime != 0 {
+		t.Fatal("single fragment should report zero reassembly time", meta.ReassemblyTime)
+	}
+}
+
+func TestFragmentSize(t *testing.T) {
+	const mtu = 1200
+	for _, target := range []string{"1.1.1.1:53", "[2001:db8::1]:53"} {
+		address := NewAddressAddrPort(netip.MustParseAddrPort(target))
+		size := FragmentSize(mtu, address)
+		packet := NewPacket(1, 1, 2, 0, uint16(size), address, make([]byte, size), Ver5)
+		if packet.BytesLen() != mtu {
+			t.Fatal(target, "encoded fragment leaves slack:", packet.BytesLen(), "!=", mtu)
+		}
+		buf := new(bytes.Buffer)
+		if err := packet.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != mtu {
+			t.Fatal(target, "BytesLen does not match the encoding:", buf.Len())
+		}
+	}
+}
+
+func TestFragWriteNativeAligned(t *testing.T) {
+	const mtu = 1200
+	quicConn := &fakeQuicConn{}
+	address := NewAddressAddrPort(netip.MustParseAddrPort("1.1.1.1:53"))
+	payload := make([]byte, 3000)
+	packet := NewPacket(1, 1, 1, 0, uint16(len(payload)), address, payload, Ver5)
+	if _, err := fragWriteNative(quicConn, DefaultPacketCodec, packet, new(bytes.Buffer), mtu, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(quicConn.messages) != 3 {
+		t.Fatal("unexpected fragment count", len(quicConn.messages))
+	}
+	for i, m := range quicConn.messages[:2] {
+		if len(m) != mtu {
+			t.Fatal("fragment", i, "is not aligned to the MTU:", len(m))
+		}
+	}
+	pc := newTestPacketConn(quicConn)
+	for _, frag := range quicConn.sentPackets(t) {
+		pc.incomingPackets.PushBack(frag)
+	}
+	buf := make([]byte, 4096)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(payload) {
+		t.Fatal("reassembled", n, "bytes")
+	}
+}
+
+type fragmentDrop struct {
+	pktId     uint16
+	fragments int
+	reason    FragmentDropReason
+}
+
+func TestFragmentDropAge(t *testing.T) {
+	pc := newTestPacketConn(&fakeQuicConn{})
+	var drops []fragmentDrop
+	pc.deFragger.OnDrop = func(pktId uint16, fragments int, reason FragmentDropReason) {
+		drops = append(drops, fragmentDrop{pktId, fragments, reason})
+	}
+	now := time.Now()
+	stale := newTestFragments(1, []byte("stale packet"), 4)
+	stale[0].receivedAt = now.Add(-2 * ReassemblyTimeout)
+	stale[1].receivedAt = now.Add(-2 * ReassemblyTimeout)
+	pc.incomingPackets.PushBack(stale[0])
+	pc.incomingPackets.PushBack(stale[1])
+	fresh := newTestFragments(2, []byte("fresh"), 4)
+	for _, frag := range fresh {
+		frag.receivedAt = now
+		pc.incomingPackets.PushBack(frag)
+	}
+	buf := make([]byte, 32)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "fresh" {
+		t.Fatal(string(buf[:n]))
+	}
+	if len(drops) != 1 || drops[0] != (fragmentDrop{1, 2, FragmentDropAge}) {
+		t.Fatal("unexpected drops", drops)
+	}
+	if pc.FragmentsDropped() != 2 || pc.deFragger.Stats().Reassembling != 0 {
+		t.Fatal("unexpected state", pc.FragmentsDropped(), pc.deFragger.Stats().Reassembling)
+	}
+}
+
+func TestFragmentDropCount(t *testing.T) {
+	pc := newTestPacketConn(&fakeQuicConn{})
+	var drops []fragmentDrop
+	pc.deFragger.OnDrop = func(pktId uint16, fragments int, reason FragmentDropReason) {
+		drops = append(drops, fragmentDrop{pktId, fragments, reason})
+	}
+	now := time.Now()
+	// Only the first fragment of each packet arrives.
+	for i := 0; i < MaxReassemblingPackets+3; i++ {
+		frag := newTestFragments(uint16(i), []byte("incomplete"), 4)[0]
+		frag.receivedAt = now.Add(time.Duration(i) * time.Millisecond)
+		pc.incomingPackets.PushBack(frag)
+	}
+	complete := newTestFragments(0xffff, []byte("x"), 4)[0]
+	complete.receivedAt = now.Add(time.Second)
+	pc.incomingPackets.PushBack(complete)
+	if _, _, err := pc.ReadFrom(make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	// The oldest ones are evicted.
+	if len(drops) != 3 || pc.deFragger.Stats().Reassembling != MaxReassemblingPackets {
+		t.Fatal("unexpected drops", drops, pc.deFragger.Stats().Reassembling)
+	}
+	for i, drop := range drops {
+		if drop != (fragmentDrop{uint16(i), 1, FragmentDropCount}) {
+			t.Fatal("unexpected drop", drop)
+		}
+	}
+	if pc.FragmentsDropped() != 3 {
+		t.Fatal(pc.FragmentsDropped())
+	}
+}
+
+func TestFlushEvicted(t *testing.T) {
+	pc := newTestPacketConn(&fakeQuicConn{})
+	var drops []fragmentDrop
+	pc.deFragger.OnDrop = func(pktId uint16, fragments int, reason FragmentDropReason) {
+		drops = append(drops, fragmentDrop{pktId, fragments, reason})
+	}
+	frag := newTestFragments(3, []byte("incomplete"), 4)[0]
+	frag.receivedAt = time.Now().Add(-ReassemblyTimeout + 50*time.Millisecond)
+	pc.incomingPackets.PushBack(frag)
+	if err := pc.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pc.ReadFrom(make([]byte, 32)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected deadline exceeded, got", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := pc.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("flush returns before eviction:", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pc.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(drops) != 1 || drops[0] != (fragmentDrop{3, 1, FragmentDropAge}) || pc.deFragger.Stats().Reassembling != 0 {
+		t.Fatal("unexpected drops", drops, pc.deFragger.Stats().Reassembling)
+	}
+}
+
+func TestFlushCompleted(t *testing.T) {
+	pc := newTestPacketConn(&fakeQuicConn{})
+	frags := newTestFragments(4, []byte("hello, world"), 8)
+	pc.incomingPackets.PushBack(frags[0])
+	if err := pc.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pc.ReadFrom(make([]byte, 32)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected deadline exceeded, got", err)
+	}
+	if err := pc.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 32)
+		n, _, _ := pc.ReadFrom(buf)
+		read <- string(buf[:n])
+	}()
+	flushed := make(chan error, 1)
+	go func() {
+		// Flush does not wait for the blocked reader.
+		flushed <- pc.Flush(context.Background())
+	}()
+	select {
+	case err := <-flushed:
+		t.Fatal("flush returns with a pending packet:", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	pc.incomingPackets.PushBack(frags[1])
+	if s := <-read; s != "hello, world" {
+		t.Fatal("unexpected packet", s)
+	}
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("flush is not woken by the completed packet")
+	}
+}
+
+func TestDeFragger(t *testing.T) {
+	var d DeFragger
+	a := newTestFragments(1, []byte("hello, world"), 4)
+	b := newTestFragments(2, []byte("goodbye"), 4)
+	buf := make([]byte, 32)
+	for _, frag := range []*Packet{a[2], b[0], a[0]} {
+		if _, _, _, assembled := d.Feed(frag, buf); assembled {
+			t.Fatal("assembled early")
+		}
+	}
+	if stats := d.Stats(); stats != (DeFraggerStats{Reassembling: 2, Buffered: 3}) {
+		t.Fatal("unexpected stats", stats)
+	}
+	n, addr, _, assembled := d.Feed(a[1], buf)
+	if !assembled || string(buf[:n]) != "hello, world" || addr.String() != "127.0.0.1:53" {
+		t.Fatal(assembled, string(buf[:n]), addr)
+	}
+	n, _, _, assembled = d.Feed(b[1], buf)
+	if !assembled || string(buf[:n]) != "goodbye" {
+		t.Fatal(assembled, string(buf[:n]))
+	}
+	if stats := d.Stats(); stats != (DeFraggerStats{}) {
+		t.Fatal("unexpected stats", stats)
+	}
+	// A packet of one fragment needs no reassembly.
+	n, _, span, assembled := d.Feed(newTestFragments(3, []byte("short"), 8)[0], buf)
+	if !assembled || string(buf[:n]) != "short" || span != 0 {
+		t.Fatal(assembled, string(buf[:n]), span)
+	}
+}
+
+func TestDeFraggerLimits(t *testing.T) {
+	var drops []fragmentDrop
+	d := DeFragger{
+		Timeout:    50 * time.Millisecond,
+		MaxPackets: 2,
+		OnDrop: func(pktId uint16, fragments int, reason FragmentDropReason) {
+			drops = append(drops, fragmentDrop{pktId, fragments, reason})
+		},
+	}
+	buf := make([]byte, 32)
+	for i := 0; i < 3; i++ {
+		frag := newTestFragments(uint16(i), []byte("incomplete"), 4)[0]
+		frag.receivedAt = time.Now().Add(time.Duration(i) * time.Millisecond)
+		d.Feed(frag, buf)
+	}
+	if len(drops) != 1 || drops[0] != (fragmentDrop{0, 1, FragmentDropCount}) {
+		t.Fatal("unexpected drops", drops)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := d.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(drops) != 3 || drops[1].reason != FragmentDropAge || drops[2].reason != FragmentDropAge {
+		t.Fatal("unexpected drops", drops)
+	}
+	if stats := d.Stats(); stats != (DeFraggerStats{Dropped: 3}) {
+		t.Fatal("unexpected stats", stats)
+	}
+}
+
+func TestDeFraggerReorderWindow(t *testing.T) {
+	var drops []fragmentDrop
+	d := DeFragger{
+		ReorderWindow: 4,
+		OnDrop: func(pktId uint16, fragments int, reason FragmentDropReason) {
+			drops = append(drops, fragmentDrop{pktId, fragments, reason})
+		},
+	}
+	buf := make([]byte, 32)
+	// Five fragments in reverse order are within the window.
+	frags := newTestFragments(1, []byte("reversed fragments"), 4)
+	var n int
+	var assembled bool
+	for i := len(frags) - 1; i >= 0; i-- {
+		n, _, _, assembled = d.Feed(frags[i], buf)
+	}
+	if !assembled || string(buf[:n]) != "reversed fragments" {
+		t.Fatal("not reassembled", string(buf[:n]), drops)
+	}
+	// Six are not.
+	frags = newTestFragments(2, []byte("too far reordered"), 3)
+	for i := len(frags) - 1; i >= 0; i-- {
+		if _, _, _, assembled = d.Feed(frags[i], buf); assembled {
+			t.Fatal("reassembled beyond the window")
+		}
+	}
+	if len(drops) != 1 || drops[0] != (fragmentDrop{2, 1, FragmentDropReorder}) {
+		t.Fatal("unexpected drops", drops)
+	}
+}
+
+func TestDeFraggerMaxPacketsPerConn(t *testing.T) {
+	var drops []fragmentDrop
+	d := DeFragger{
+		MaxPacketsPerConn: 4,
+		OnDrop: func(pktId uint16, fragments int, reason FragmentDropReason) {
+			drops = append(drops, fragmentDrop{pktId, fragments, reason})
+		},
+	}
+	buf := make([]byte, 32)
+	now := time.Now()
+	// Session 2 starts two packets, reusing the PKT_IDs of session 1.
+	var others []*Packet
+	for i := 0; i < 2; i++ {
+		frags := newTestFragments(uint16(i), []byte("other"), 4)
+		for _, frag := range frags {
+			frag.ASSOC_ID = 2
+			frag.receivedAt = now
+		}
+		d.Feed(frags[0], buf)
+		others = append(others, frags[1])
+	}
+	// Session 1 floods distinct PKT_IDs.
+	for i := 0; i < 10; i++ {
+		frag := newTestFragments(uint16(i), []byte("incomplete"), 4)[0]
+		frag.receivedAt = now.Add(time.Duration(i+1) * time.Millisecond)
+		d.Feed(frag, buf)
+		if stats := d.Stats(); stats.Reassembling > 4+2 {
+			t.Fatal("the cap does not hold", stats)
+		}
+	}
+	if len(drops) != 6 {
+		t.Fatal("unexpected drops", drops)
+	}
+	for i, drop := range drops {
+		if drop != (fragmentDrop{uint16(i), 1, FragmentDropConnCount}) {
+			t.Fatal("unexpected drop", drop)
+		}
+	}
+	// The packets of session 2 are not evicted.
+	for _, frag := range others {
+		n, _, _, assembled := d.Feed(frag, buf)
+		if !assembled || string(buf[:n]) != "other" {
+			t.Fatal("not reassembled", string(buf[:n]))
+		}
+	}
+	if stats := d.Stats(); stats.Reassembling != 4 {
+		t.Fatal("unexpected stats", stats)
+	}
+}
+
+func TestDeFraggerSharedByConns(t *testing.T) {
+	// Without the cap per ASSOC_ID, the flood would evict through MaxPackets
+	// the packets session 2 is reassembling.
+	d := DeFragger{MaxPackets: 6, MaxPacketsPerConn: 4}
+	buf := make([]byte, 32)
+	now := time.Now()
+	tick := 0
+	feed := func(frag *Packet, assocId uint16) (int, bool) {
+		tick++
+		frag.ASSOC_ID = assocId
+		frag.receivedAt = now.Add(time.Duration(tick) * time.Millisecond)
+		n, _, _, assembled := d.Feed(frag, buf)
+		return n, assembled
+	}
+	for i := 0; i < 20; i++ {
+		frags := newTestFragments(uint16(i), []byte("other"), 4)
+		feed(frags[0], 2)
+		// Session 1 floods distinct PKT_IDs in the meantime.
+		for j := 0; j < 3; j++ {
+			feed(newTestFragments(uint16(1000+3*i+j), []byte("incomplete"), 4)[0], 1)
+		}
+		if n, assembled := feed(frags[1], 2); !assembled || string(buf[:n]) != "other" {
+			t.Fatal("session 2 is starved at packet", i)
+		}
+	}
+	if stats := d.Stats(); stats.Reassembling != 4 {
+		t.Fatal("unexpected stats", stats)
+	}
+}
+
+func TestRecvSeq(t *testing.T) {
+	pc := newTestPacketConn(&fakeQuicConn{})
+	first := newTestFragments(1, []byte("first packet"), 6)
+	second := newTestFragments(2, []byte("second"), 6)
+	third := newTestFragments(3, []byte("third"), 6)
+	// The second and the third packet complete before the first one.
+	for _, frag := range []*Packet{first[0], second[0], third[0], first[1]} {
+		pc.incomingPackets.PushBack(frag)
+	}
+	buf := make([]byte, 32)
+	expected := []uint16{2, 3, 1}
+	var lastSeq uint64
+	for i, pktId := range expected {
+		_, _, meta, err := pc.ReadFromEx(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.PktId != pktId {
+			t.Fatal(i, meta.PktId, "!=", pktId)
+		}
+		if meta.RecvSeq <= lastSeq {
+			t.Fatal("receive sequence is not increasing", lastSeq, meta.RecvSeq)
+		}
+		lastSeq = meta.RecvSeq
+	}
+	if lastSeq != 3 {
+		t.Fatal("unexpected last sequence", lastSeq)
+	}
+}
@@ -0,0 +1,44 @@
+package tuic
+
+import "github.com/mzz2017/quic-go"
+
+// HandshakeInfo describes the handshake of a QUIC connection.
+type HandshakeInfo struct {
+	// RoundTrips is the number of round trips before data could be sent: 0 with
+	// 0-RTT and 1 otherwise. A Retry from the server is not counted.
+	RoundTrips int
+	// Used0RTT says if 0-RTT data was accepted by the server.
+	Used0RTT bool
+	// Resumed says if the TLS session was resumed.
+	Resumed bool
+}
+
+func newHandshakeInfo(state quic.ConnectionState) HandshakeInfo {
+	info := HandshakeInfo{
+		RoundTrips: 1,
+		Used0RTT:   state.Used0RTT,
+		Resumed:    state.TLS.DidResume,
+	}
+	if state.Used0RTT {
+		info.RoundTrips = 0
+	}
+	return info
+}
+
+// HandshakeInfo returns the handshake of the current connection. ok is false
+// if the client is not connected.
+func (t *clientImpl) HandshakeInfo() (info HandshakeInfo, ok bool) {
+	t.connMutex.Lock()
+	quicConn := t.quicConn
+	t.connMutex.Unlock()
+	if quicConn == nil {
+		return HandshakeInfo{}, false
+	}
+	return newHandshakeInfo(quicConn.ConnectionState()), true
+}
+
+// HandshakeInfo returns the handshake of the connection the packet conn uses.
+func (q *quicStreamPacketConn) HandshakeInfo() HandshakeInfo {
+	quicConn, _ := q.conn()
+	return newHandshakeInfo(quicConn.ConnectionState())
+}
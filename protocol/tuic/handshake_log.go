@@ -0,0 +1,62 @@
+package tuic
+
+import (
+	"encoding/hex"
+	"fmt"
+	"syscall"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+// handshakeLogConn reports the outbound datagrams that start with a QUIC long
+// header packet, i.e. the Initial and Handshake packets carrying the
+// ClientHello, before sending them unchanged. It forwards the optional methods
+// of the conn that quic-go looks for.
+type handshakeLogConn struct {
+	netproxy.PacketConn
+	onHandshakeBytes func(hexBytes string)
+}
+
+func isLongHeaderPacket(b []byte) bool {
+	return len(b) > 0 && b[0]&0x80 != 0
+}
+
+func (c *handshakeLogConn) WriteTo(p []byte, addr string) (n int, err error) {
+	if isLongHeaderPacket(p) {
+		c.onHandshakeBytes(hex.EncodeToString(p))
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *handshakeLogConn) Write(b []byte) (n int, err error) {
+	if isLongHeaderPacket(b) {
+		c.onHandshakeBytes(hex.EncodeToString(b))
+	}
+	return c.PacketConn.Write(b)
+}
+
+func (c *handshakeLogConn) SetWriteBuffer(size int) error {
+	conn, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error })
+	if !ok {
+		return fmt.Errorf("connection doesn't allow setting of send buffer size. Not a *net.UDPConn?")
+	}
+	return conn.SetWriteBuffer(size)
+}
+
+func (c *handshakeLogConn) SetReadBuffer(size int) error {
+	conn, ok := c.PacketConn.(interface{ SetReadBuffer(int) error })
+	if !ok {
+		return fmt.Errorf("connection doesn't allow setting of receive buffer size. Not a *net.UDPConn?")
+	}
+	return conn.SetReadBuffer(size)
+}
+
+func (c *handshakeLogConn) SyscallConn() (syscall.RawConn, error) {
+	conn, ok := c.PacketConn.(interface {
+		SyscallConn() (syscall.RawConn, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("connection doesn't allow to get Syscall.RawConn. Not a *net.UDPConn?")
+	}
+	return conn.SyscallConn()
+}
@@ -0,0 +1,34 @@
+package tuic
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/mzz2017/quic-go"
+)
+
+func TestHandshakeInfo(t *testing.T) {
+	tt := []struct {
+		name     string
+		state    quic.ConnectionState
+		expected HandshakeInfo
+	}{
+		{"full", quic.ConnectionState{}, HandshakeInfo{RoundTrips: 1}},
+		{"resumed", quic.ConnectionState{TLS: tls.ConnectionState{DidResume: true}}, HandshakeInfo{RoundTrips: 1, Resumed: true}},
+		{"0-rtt", quic.ConnectionState{TLS: tls.ConnectionState{DidResume: true}, Used0RTT: true}, HandshakeInfo{RoundTrips: 0, Used0RTT: true, Resumed: true}},
+	}
+	for _, test := range tt {
+		quicConn := &fakeQuicConn{state: test.state}
+		cli := newTestClient(quicConn)
+		info, ok := cli.HandshakeInfo()
+		if !ok || info != test.expected {
+			t.Fatal(test.name, info, ok)
+		}
+		if info = listenTestPacket(t, cli, "1.1.1.1:53").HandshakeInfo(); info != test.expected {
+			t.Fatal(test.name, info)
+		}
+	}
+	if _, ok := (&clientImpl{ClientOption: &ClientOption{}}).HandshakeInfo(); ok {
+		t.Fatal("HandshakeInfo of a client without connection")
+	}
+}
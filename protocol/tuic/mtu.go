@@ -0,0 +1,144 @@
+package tuic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"github.com/daeuniverse/softwind/protocol"
+)
+
+// quicDatagramOverhead is the most a QUIC short header packet with a single
+// DATAGRAM frame adds to the payload: the header with a connection ID of up to
+// 20 bytes and a packet number of up to 4 bytes, the AEAD tag, and the frame
+// type and length.
+const quicDatagramOverhead = 1 + 20 + 4 + 16 + 1 + 2
+
+var errPathMTUUnsupported = errors.New("path MTU is not available on this platform")
+
+// AutoTuneMTU reads the path MTU to the server, which the kernel learns from
+// the traffic of the connection, and lowers the max packet size of the session
+// so that a native relay datagram, fragments included, fits in one IP packet.
+// It returns the max packet size in use. Call it once the connection has
+// carried some traffic so that the MTU is settled; it never raises the size
+// above the configured one.
+func (q *quicStreamPacketConn) AutoTuneMTU(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	q.muConn.Lock()
+	quicConn, pathMTU := q.quicConn, q.pathMTU
+	q.muConn.Unlock()
+	if pathMTU == nil {
+		return 0, errPathMTUUnsupported
+	}
+	mtu, err := pathMTU()
+	if err != nil {
+		return 0, fmt.Errorf("get path MTU: %w", err)
+	}
+	ipOverhead := 40 + 8
+	if addr, ok := quicConn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		ipOverhead = 20 + 8
+	}
+	size := mtu - ipOverhead - quicDatagramOverhead - PacketOverHead
+	if size < 1 {
+		return 0, fmt.Errorf("path MTU too small: %v", mtu)
+	}
+	q.lowerMaxPacketSize(size)
+	return q.maxPacketSize(), nil
+}
+
+// socketPathMTU returns the path MTU from the socket conn to raddr. The path
+// MTU is only available on connected sockets, which conn is not if it is
+// shared by peers, as those of net.ListenUDP are. Then a socket connected to
+// raddr is opened to read the path MTU the kernel has cached for raddr.
+func socketPathMTU(conn net.PacketConn, raddr net.Addr) (int, error) {
+	mtu, err := connPathMTU(conn)
+	if !errors.Is(err, syscall.ENOTCONN) {
+		return mtu, err
+	}
+	udpAddr, ok := raddr.(*net.UDPAddr)
+	if !ok {
+		return 0, err
+	}
+	probe, dialErr := net.DialUDP("udp", nil, udpAddr)
+	if dialErr != nil {
+		return 0, fmt.Errorf("%w; dial probe socket: %v", err, dialErr)
+	}
+	defer probe.Close()
+	return connPathMTU(probe)
+}
+
+// connPathMTU returns the path MTU of the connected socket conn.
+func connPathMTU(conn net.PacketConn) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, fmt.Errorf("%w: %T has no socket", errPathMTUUnsupported, conn)
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	return rawPathMTU(rawConn)
+}
+
+// mtuOverrides maps targets to the max packet sizes of them, as given by
+// ClientConfig.MtuOverrides.
+type mtuOverrides struct {
+	matcher *protocol.TargetMatcher
+	// sizes holds the size of each rule of matcher.
+	sizes []int
+}
+
+// newMtuOverrides parses overrides. It returns nil if overrides is empty.
+func newMtuOverrides(overrides map[string]int, maxSize int) (*mtuOverrides, error) {
+	if len(overrides) == 0 {
+		return nil, nil
+	}
+	o := &mtuOverrides{}
+	rules := make([]string, 0, len(overrides))
+	for target, size := range overrides {
+		if size < 1 || size > maxSize {
+			return nil, fmt.Errorf("bad max packet size of %v: should be in range [1, %v]", target, maxSize)
+		}
+		rules = append(rules, target)
+		o.sizes = append(o.sizes, size)
+	}
+	matcher, err := protocol.NewTargetMatcher(rules)
+	if err != nil {
+		return nil, fmt.Errorf("bad MTU override target: %w", err)
+	}
+	o.matcher = matcher
+	return o, nil
+}
+
+// lookup returns the max packet size of the target address. ok is false if
+// no override matches it.
+func (o *mtuOverrides) lookup(address *Address) (size int, ok bool) {
+	if o == nil {
+		return 0, false
+	}
+	var rule int
+	if address.TYPE == AtypDomainName {
+		rule, ok = o.matcher.MatchDomain(string(address.ADDR[1:]))
+	} else if addr, valid := netip.AddrFromSlice(address.ADDR); valid {
+		rule, ok = o.matcher.MatchAddr(addr)
+	}
+	if !ok {
+		return 0, false
+	}
+	return o.sizes[rule], true
+}
+
+// maxPacketSizeTo returns the max payload size of a datagram to address
+// without fragmentation, which an override of the target may lower.
+func (q *quicStreamPacketConn) maxPacketSizeTo(address *Address) int {
+	size := q.maxPacketSize()
+	if override, ok := q.mtuOverrides.lookup(address); ok && override < size {
+		return override
+	}
+	return size
+}
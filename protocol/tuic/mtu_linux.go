@@ -0,0 +1,25 @@
+package tuic
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func rawPathMTU(rawConn syscall.RawConn) (mtu int, err error) {
+	controlErr := rawConn.Control(func(fd uintptr) {
+		var sa unix.Sockaddr
+		if sa, err = unix.Getsockname(int(fd)); err != nil {
+			return
+		}
+		if _, ok := sa.(*unix.SockaddrInet6); ok {
+			mtu, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU)
+		} else {
+			mtu, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU)
+		}
+	})
+	if controlErr != nil {
+		return 0, controlErr
+	}
+	return mtu, err
+}
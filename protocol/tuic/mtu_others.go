@@ -0,0 +1,9 @@
+//go:build !linux
+
+package tuic
+
+import "syscall"
+
+func rawPathMTU(rawConn syscall.RawConn) (int, error) {
+	return 0, errPathMTUUnsupported
+}
@@ -0,0 +1,128 @@
+package tuic
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestAutoTuneMTU(t *testing.T) {
+	quicConn := &fakeQuicConn{}
+	pc := newTestPacketConn(quicConn)
+	if _, err := pc.AutoTuneMTU(context.Background()); !errors.Is(err, errPathMTUUnsupported) {
+		t.Fatal(err)
+	}
+	pc.pathMTU = func() (int, error) { return 1280, nil }
+	size, err := pc.AutoTuneMTU(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := 1280 - 20 - 8 - quicDatagramOverhead - PacketOverHead
+	if size != expected || pc.maxPacketSize() != expected {
+		t.Fatal(size, pc.maxPacketSize(), "!=", expected)
+	}
+	// A fragment of a large packet fits in the path MTU.
+	if _, err = pc.WriteTo(make([]byte, 3000), "[2001:db8::1]:53"); err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range quicConn.messages {
+		if len(m)+20+8+quicDatagramOverhead > 1280 {
+			t.Fatal("datagram", i, "exceeds the path MTU:", len(m))
+		}
+	}
+
+	// The size is never raised above the configured one.
+	pc = newTestPacketConn(&fakeQuicConn{})
+	pc.pathMTU = func() (int, error) { return 9000, nil }
+	if size, err = pc.AutoTuneMTU(context.Background()); err != nil || size != 1400 {
+		t.Fatal(size, err)
+	}
+}
+
+func TestSocketPathMTU(t *testing.T) {
+	lis, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	conn, err := net.DialUDP("udp", nil, lis.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	mtu, err := socketPathMTU(conn, lis.LocalAddr())
+	if errors.Is(err, errPathMTUUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil || mtu < 1280 {
+		t.Fatal(mtu, err)
+	}
+
+	// An unconnected socket, as the direct dialer listens on, falls back to a
+	// connected probe socket.
+	unconnected, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unconnected.Close()
+	if _, err = connPathMTU(unconnected); !errors.Is(err, syscall.ENOTCONN) {
+		t.Fatal("unexpected error", err)
+	}
+	if probed, err := socketPathMTU(unconnected, lis.LocalAddr()); err != nil || probed != mtu {
+		t.Fatal(probed, err)
+	}
+}
+
+func TestMtuOverrides(t *testing.T) {
+	overrides, err := newMtuOverrides(map[string]int{
+		"10.0.0.0/8":    600,
+		"10.1.0.0/16":   200,
+		"2001:db8::1":   200,
+		"Example.com":   200,
+		"a.example.com": 600,
+	}, 1400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quicConn := &fakeQuicConn{}
+	pc := newTestPacketConn(quicConn)
+	pc.mtuOverrides = overrides
+	payload := make([]byte, 500)
+	for _, test := range []struct {
+		target    string
+		fragments int
+	}{
+		{"10.1.2.3:53", 3},
+		{"10.2.3.4:53", 1},
+		{"[2001:db8::1]:53", 3},
+		{"example.com:53", 3},
+		{"www.example.com:53", 3},
+		{"a.example.com:53", 1},
+		{"b.a.example.com:53", 1},
+		{"notexample.com:53", 1},
+		{"192.168.1.1:53", 1},
+		{"example.org:53", 1},
+	} {
+		quicConn.mu.Lock()
+		quicConn.messages = nil
+		quicConn.mu.Unlock()
+		if _, err = pc.WriteTo(payload, test.target); err != nil {
+			t.Fatal(err)
+		}
+		if packets := quicConn.sentPackets(t); len(packets) != test.fragments {
+			t.Fatal(test.target, "unexpected fragments", len(packets))
+		}
+	}
+	for _, bad := range []map[string]int{
+		{"10.0.0.0/8": 0},
+		{"10.0.0.0/8": 1401},
+		{"10.0.0.0/33": 100},
+		{"example.com:53": 100},
+	} {
+		if _, err = newMtuOverrides(bad, 1400); err == nil {
+			t.Fatal("expected error", bad)
+		}
+	}
+}
@@ -2,15 +2,18 @@ package tuic
 
 import (
 	"container/list"
+	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/netip"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/daeuniverse/softwind/netproxy"
 	"github.com/daeuniverse/softwind/pkg/fastrand"
-	"github.com/daeuniverse/softwind/pool"
 	"github.com/daeuniverse/softwind/protocol"
 	"github.com/daeuniverse/softwind/protocol/tuic/common"
 	"github.com/mzz2017/quic-go"
@@ -33,6 +36,9 @@ func NewPackets() *Packets {
 func (p *Packets) PushBack(packet *Packet) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	if packet.receivedAt.IsZero() {
+		packet.receivedAt = time.Now()
+	}
 	p.list.PushBack(packet)
 	select {
 	case <-p.nonEmpty:
@@ -42,17 +48,31 @@ func (p *Packets) PushBack(packet *Packet) {
 }
 
 func (p *Packets) PopFrontBlock() (packet *Packet, closed bool) {
-	<-p.nonEmpty
-	if p.closed {
-		return nil, true
+	packet, closed, _ = p.PopFrontDeadline(nil)
+	return packet, closed
+}
+
+// PopFrontDeadline is like PopFrontBlock but gives up with timeout set once
+// deadline is closed. A nil deadline never fires.
+func (p *Packets) PopFrontDeadline(deadline <-chan struct{}) (packet *Packet, closed bool, timeout bool) {
+	p.mu.Lock()
+	nonEmpty := p.nonEmpty
+	p.mu.Unlock()
+	select {
+	case <-nonEmpty:
+	case <-deadline:
+		return nil, false, true
 	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	if p.closed {
+		return nil, true, false
+	}
 	packet = p.list.Remove(p.list.Front()).(*Packet)
 	if p.list.Len() == 0 {
 		p.setEmpty()
 	}
-	return packet, false
+	return packet, false, false
 }
 
 func (p *Packets) setEmpty() {
@@ -74,10 +94,134 @@ func (p *Packets) Close() error {
 	return nil
 }
 
+var (
+	ErrLocalClose = errors.New("closed by local")
+	ErrPeerClose  = errors.New("closed by peer")
+	// ErrPktIdInUse is returned by WriteToPktId if the PKT_ID is sent recently.
+	ErrPktIdInUse = errors.New("PKT_ID in use")
+)
+
+// CloseError is returned by operations on a closed packet conn. It satisfies
+// errors.Is(err, net.ErrClosed).
+type CloseError struct {
+	// Cause is ErrLocalClose or ErrPeerClose.
+	Cause error
+	// Code and Reason are given by the peer if Cause is ErrPeerClose.
+	Code   quic.ApplicationErrorCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Cause == ErrPeerClose {
+		return fmt.Sprintf("%v: %v: code %#x: %v", net.ErrClosed, e.Cause, uint64(e.Code), e.Reason)
+	}
+	return fmt.Sprintf("%v: %v", net.ErrClosed, e.Cause)
+}
+
+func (e *CloseError) Is(target error) bool {
+	return target == net.ErrClosed || target == e.Cause
+}
+
+// WriteDropReason tells why a write of a packet conn drops the packet.
+type WriteDropReason int
+
+const (
+	// WriteDropClosed means the packet conn is closed.
+	WriteDropClosed WriteDropReason = iota
+	// WriteDropExpired means the write deadline is exceeded.
+	WriteDropExpired
+	// WriteDropTooLarge means the packet is too large to be sent, even in
+	// fragments.
+	WriteDropTooLarge
+	// WriteDropPktIdInUse means the PKT_ID given to WriteToPktId is in use.
+	WriteDropPktIdInUse
+	// WriteDropBadTarget means the target address cannot be parsed.
+	WriteDropBadTarget
+)
+
+func (r WriteDropReason) String() string {
+	switch r {
+	case WriteDropClosed:
+		return "closed"
+	case WriteDropExpired:
+		return "expired"
+	case WriteDropTooLarge:
+		return "too large"
+	case WriteDropPktIdInUse:
+		return "PKT_ID in use"
+	case WriteDropBadTarget:
+		return "bad target"
+	default:
+		return "unknown"
+	}
+}
+
+// WriteDropError is returned by the writes of packet conns that drop the
+// packet for Reason. Err is the underlying error, so errors.Is(err,
+// net.ErrClosed) and errors.Is(err, os.ErrDeadlineExceeded) still hold.
+// Other errors of the connection are returned as they are. Only those and
+// WriteDropClosed close the connection of the client.
+type WriteDropError struct {
+	Reason WriteDropReason
+	Err    error
+}
+
+func (e *WriteDropError) Error() string {
+	return fmt.Sprintf("packet dropped: %v: %v", e.Reason, e.Err)
+}
+
+func (e *WriteDropError) Unwrap() error {
+	return e.Err
+}
+
+// newWriteDropError returns err as a WriteDropError if it drops the packet
+// for a known reason, and err otherwise.
+func newWriteDropError(err error) error {
+	var dropErr *WriteDropError
+	var tooLarge quic.ErrMessageTooLarge
+	var reason WriteDropReason
+	switch {
+	case err == nil || errors.As(err, &dropErr):
+		return err
+	case errors.Is(err, net.ErrClosed):
+		reason = WriteDropClosed
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		reason = WriteDropExpired
+	case errors.As(err, &tooLarge):
+		reason = WriteDropTooLarge
+	case errors.Is(err, ErrPktIdInUse):
+		reason = WriteDropPktIdInUse
+	default:
+		return err
+	}
+	return &WriteDropError{Reason: reason, Err: err}
+}
+
 type quicStreamPacketConn struct {
-	mu sync.Mutex
+	// Keep the 64-bit atomic counters first for alignment on 32-bit platforms.
+	rxBytes uint64
+	txBytes uint64
+	// maxPacketSizeCeil lowers maxUdpRelayPacketSize once a datagram turns out
+	// to be too large. 0 means no ceiling.
+	maxPacketSizeCeil int64
+	// streamCloseErrors counts uni streams of QUIC relay mode that fail to
+	// close.
+	streamCloseErrors uint64
+
+	// mu guards incomingPackets. muRead serializes readers. Neither is held
+	// by WriteTo, and mu is never held while blocking in ReadFrom.
+	mu     sync.Mutex
+	muRead sync.Mutex
+	// recvSeq is the RecvSeq of the last packet read. It is guarded by muRead.
+	recvSeq uint64
+	// muConn guards quicConn, targetStreams and pathMTU, which change when
+	// the session migrates to another connection. Nothing is called with it
+	// held.
+	muConn sync.Mutex
 
 	target string
+	// fixed holds the *fixedTarget set by SetTarget, which replaces target.
+	fixed atomic.Value
 
 	connId          uint16
 	quicConn        quic.Connection
@@ -85,6 +229,24 @@ type quicStreamPacketConn struct {
 
 	udpRelayMode          common.UdpRelayMode
 	maxUdpRelayPacketSize int
+	// mtuOverrides lowers the max packet size to some targets. It may be nil.
+	mtuOverrides *mtuOverrides
+
+	sequentialPktId bool
+	padMultiple     int
+	// pktIdCounter is only used if sequentialPktId is set.
+	pktIdCounter uint32
+	// muPktId guards pktIdsInUse, which maps the PKT_IDs passed to
+	// WriteToPktId to the time they are sent.
+	muPktId        sync.Mutex
+	pktIdsInUse    map[uint16]time.Time
+	lastPktIdSweep time.Time
+	// addressCache caches Addresses of recent targets. It may be nil.
+	addressCache *addressCache
+	// codec is DefaultPacketCodec if nil.
+	codec PacketCodec
+	// targetStreams is only used in QUIC relay mode. It may be nil.
+	targetStreams *targetStreams
 
 	deferQuicConnFn func(quicConn quic.Connection, err error)
 	closeDeferFn    func()
@@ -93,11 +255,68 @@ type quicStreamPacketConn struct {
 	closeErr  error
 	closed    bool
 
-	// TODO: multiple defraggers for different PKT_ID
-	deFraggers sync.Map
+	muDissociate sync.Mutex
+	dissociated  bool
+
+	// deFragger reassembles incoming packets. Readers feed it, and it is
+	// drained by Flush.
+	deFragger DeFragger
+
+	muTimer           sync.Mutex
+	readDeadline      time.Time
+	readDeadlineTimer *time.Timer
+	// readClosed is closed once the read deadline is exceeded. nil means no
+	// deadline has been set.
+	readClosed    chan struct{}
+	writeDeadline time.Time
+	// defaultWriteTimeout bounds each WriteTo if no write deadline is set. 0
+	// disables it.
+	defaultWriteTimeout time.Duration
+	// stalledSend is closed once the last datagram send given up on at its
+	// deadline returns. It is guarded by muTimer and nil if there is none.
+	stalledSend chan struct{}
 
-	muTimer       sync.Mutex
-	deadlineTimer *time.Timer
+	createdAt time.Time
+	rxRate    rateEstimator
+	txRate    rateEstimator
+	// client is the client the packet conn belongs to. It may be nil.
+	client *clientImpl
+	// pathMTU returns the path MTU to the server. It may be nil.
+	pathMTU func() (int, error)
+	// alloc holds the allocatorHolder set by SetAllocator.
+	alloc atomic.Value
+}
+
+// Done returns a channel that is closed once the underlying connection fails
+// or is closed.
+func (q *quicStreamPacketConn) Done() <-chan struct{} {
+	if q.client == nil {
+		return nil
+	}
+	return q.client.Done()
+}
+
+// Err returns the terminal error of the underlying connection, or nil if it is
+// alive.
+func (q *quicStreamPacketConn) Err() error {
+	if q.client == nil {
+		return nil
+	}
+	return q.client.Err()
+}
+
+func (q *quicStreamPacketConn) sessionInfo(now time.Time) SessionInfo {
+	return SessionInfo{
+		ConnId:  q.connId,
+		Target:  q.writeTarget(),
+		RxBytes: atomic.LoadUint64(&q.rxBytes),
+		TxBytes: atomic.LoadUint64(&q.txBytes),
+		Age:     now.Sub(q.createdAt),
+		RxRate:  q.rxRate.Rate(now),
+		TxRate:  q.txRate.Rate(now),
+
+		FragmentsDropped: q.deFragger.Stats().Dropped,
+	}
 }
 
 func (q *quicStreamPacketConn) Close() error {
@@ -114,158 +333,585 @@ func (q *quicStreamPacketConn) close() (err error) {
 	if q.closeDeferFn != nil {
 		defer q.closeDeferFn()
 	}
+	quicConn, targetStreams := q.conn()
 	if q.deferQuicConnFn != nil {
 		defer func() {
-			q.deferQuicConnFn(q.quicConn, err)
+			q.deferQuicConnFn(quicConn, err)
 		}()
 	}
+	if targetStreams != nil {
+		targetStreams.Close()
+	}
 	if q.incomingPackets != nil {
+		// Wake up blocked readers.
+		_ = q.incomingPackets.Close()
 		q.incomingPackets = nil
+		err = q.dissociate(quicConn)
+	}
+	return
+}
 
-		buf := pool.GetBuffer()
-		defer pool.PutBuffer(buf)
-		err = NewDissociate(q.connId, Ver5).WriteTo(buf)
-		if err != nil {
-			return
-		}
-		var stream quic.SendStream
-		stream, err = q.quicConn.OpenUniStream()
-		if err != nil {
-			return
-		}
-		_, err = buf.WriteTo(stream)
-		if err != nil {
-			return
+// conn returns the QUIC connection of the session and its target streams.
+func (q *quicStreamPacketConn) conn() (quic.Connection, *targetStreams) {
+	q.muConn.Lock()
+	defer q.muConn.Unlock()
+	return q.quicConn, q.targetStreams
+}
+
+// migrate moves the session from the connection from to the connection to,
+// which is dialed over socket. The server is told to release the session on
+// from, and it is associated on to by the next packet sent. Target streams of
+// from are closed. It does nothing if the session is closed or not on from.
+func (q *quicStreamPacketConn) migrate(from quic.Connection, to quic.Connection, socket net.PacketConn) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	quicConn, targetStreams := q.conn()
+	if q.incomingPackets == nil || quicConn != from {
+		return
+	}
+	_ = q.dissociate(from)
+	q.muDissociate.Lock()
+	q.dissociated = false
+	q.muDissociate.Unlock()
+
+	q.muConn.Lock()
+	q.quicConn = to
+	if targetStreams != nil {
+		q.targetStreams = newTargetStreams(targetStreams.size)
+	}
+	if socket != nil {
+		q.pathMTU = func() (int, error) {
+			return socketPathMTU(socket, to.RemoteAddr())
 		}
-		err = stream.Close()
-		if err != nil {
-			return
+	}
+	q.muConn.Unlock()
+	if targetStreams != nil {
+		targetStreams.Close()
+	}
+}
+
+// dissociate tells the server to release the UDP session on quicConn.
+// Dissociate is sent at most once until the session migrates.
+func (q *quicStreamPacketConn) dissociate(quicConn quic.Connection) (err error) {
+	q.muDissociate.Lock()
+	defer q.muDissociate.Unlock()
+	if q.dissociated {
+		return nil
+	}
+	q.dissociated = true
+
+	dissociate := NewDissociate(q.connId, Ver5)
+	buf, putBuffer := q.getBuffer(dissociate.BytesLen())
+	defer putBuffer()
+	err = dissociate.WriteTo(buf)
+	if err != nil {
+		return
+	}
+	var stream quic.SendStream
+	stream, err = quicConn.OpenUniStream()
+	if err != nil {
+		return
+	}
+	_, err = buf.WriteTo(stream)
+	if err != nil {
+		return
+	}
+	return stream.Close()
+}
+
+// closedError tells who closed the packet conn.
+func (q *quicStreamPacketConn) closedError() error {
+	if !q.closed {
+		quicConn, _ := q.conn()
+		if ctx := quicConn.Context(); ctx.Err() != nil {
+			var appErr *quic.ApplicationError
+			if errors.As(context.Cause(ctx), &appErr) && appErr.Remote {
+				return &CloseError{Cause: ErrPeerClose, Code: appErr.ErrorCode, Reason: appErr.ErrorMessage}
+			}
 		}
 	}
-	return
+	return &CloseError{Cause: ErrLocalClose}
 }
 
 func (q *quicStreamPacketConn) SetDeadline(t time.Time) error {
+	if err := q.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return q.SetWriteDeadline(t)
+}
+
+// SetReadDeadline makes ReadFrom return os.ErrDeadlineExceeded after t. It does
+// not close the packet conn, and fragments received so far are kept for the
+// following reads.
+func (q *quicStreamPacketConn) SetReadDeadline(t time.Time) error {
 	q.muTimer.Lock()
 	defer q.muTimer.Unlock()
-	dur := time.Until(t)
-	if q.deadlineTimer != nil {
-		q.deadlineTimer.Reset(dur)
-	} else {
-		q.deadlineTimer = time.AfterFunc(dur, func() {
+	if q.readDeadlineTimer != nil {
+		q.readDeadlineTimer.Stop()
+		q.readDeadlineTimer = nil
+	}
+	// Keep the channel a blocked reader is waiting on unless it is closed.
+	if q.readClosed == nil || isClosedChan(q.readClosed) {
+		q.readClosed = make(chan struct{})
+	}
+	q.readDeadline = t
+	switch {
+	case t.IsZero():
+	case !t.After(time.Now()):
+		close(q.readClosed)
+	default:
+		q.readDeadlineTimer = time.AfterFunc(time.Until(t), func() {
 			q.muTimer.Lock()
 			defer q.muTimer.Unlock()
-			q.Close()
-			q.deadlineTimer = nil
+			// Ignore a stale timer if the deadline has been moved.
+			if !q.readDeadline.IsZero() && !time.Now().Before(q.readDeadline) && !isClosedChan(q.readClosed) {
+				close(q.readClosed)
+			}
 		})
 	}
 	return nil
 }
 
-func (q *quicStreamPacketConn) SetReadDeadline(t time.Time) error {
-	// FIXME: Single direction.
-	return q.SetDeadline(t)
+// SetWriteDeadline makes WriteTo return os.ErrDeadlineExceeded after t. It
+// overrides the default write timeout until it is reset to zero.
+func (q *quicStreamPacketConn) SetWriteDeadline(t time.Time) error {
+	q.muTimer.Lock()
+	defer q.muTimer.Unlock()
+	q.writeDeadline = t
+	return nil
 }
 
-func (q *quicStreamPacketConn) SetWriteDeadline(t time.Time) error {
-	// FIXME: Single direction.
-	return q.SetDeadline(t)
+func (q *quicStreamPacketConn) readDeadlineChan() <-chan struct{} {
+	q.muTimer.Lock()
+	defer q.muTimer.Unlock()
+	return q.readClosed
+}
+
+// writeDeadlineAt returns the deadline of a write starting at now: the one set
+// by SetWriteDeadline, or defaultWriteTimeout from now. It is zero if there is
+// neither.
+func (q *quicStreamPacketConn) writeDeadlineAt(now time.Time) time.Time {
+	q.muTimer.Lock()
+	defer q.muTimer.Unlock()
+	if !q.writeDeadline.IsZero() {
+		return q.writeDeadline
+	}
+	if q.defaultWriteTimeout > 0 {
+		return now.Add(q.defaultWriteTimeout)
+	}
+	return time.Time{}
+}
+
+// deadlineQuicConn makes SendMessage give up at deadline. The datagram may
+// still be sent after that. quic-go has no SendMessage taking a context, so
+// the send is left running in a goroutine, until the datagram is dequeued or
+// the connection is closed. Following sends wait for it, so that a stalled
+// connection does not pile up goroutines.
+type deadlineQuicConn struct {
+	quic.Connection
+	deadline time.Time
+	pc       *quicStreamPacketConn
+}
+
+func (c *deadlineQuicConn) SendMessage(b []byte) error {
+	timeout := time.Until(c.deadline)
+	if timeout <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	c.pc.muTimer.Lock()
+	stalled := c.pc.stalledSend
+	c.pc.muTimer.Unlock()
+	if stalled != nil {
+		select {
+		case <-stalled:
+		case <-timer.C:
+			return os.ErrDeadlineExceeded
+		}
+	}
+	// b is reused by the caller once SendMessage returns.
+	data := make([]byte, len(b))
+	copy(data, b)
+	done := make(chan struct{})
+	var err error
+	go func() {
+		err = c.Connection.SendMessage(data)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-timer.C:
+		c.pc.muTimer.Lock()
+		c.pc.stalledSend = done
+		c.pc.muTimer.Unlock()
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func isClosedChan(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadMeta describes a packet returned by ReadFromEx.
+//
+// It does not tell whether a datagram took more than one QUIC packet: a QUIC
+// datagram is always carried in a single QUIC packet (RFC 9221), and quic-go
+// reports neither the packets nor the IP fragmentation of a received datagram.
+// Only the fragmentation by TUIC itself shows, as a non-zero ReassemblyTime.
+type ReadMeta struct {
+	// ReassemblyTime is the time between the arrivals of the first and the last
+	// fragment of the packet. It is zero for packets that are not fragmented.
+	ReassemblyTime time.Duration
+	// PktId is the PKT_ID of the packet.
+	PktId uint16
+	// RecvSeq numbers the packets delivered by the packet conn from 1 in the
+	// order they are delivered, so that callers can compare it with the order
+	// they were sent in to detect reordering.
+	RecvSeq uint64
 }
 
 func (q *quicStreamPacketConn) ReadFrom(p []byte) (n int, addr netip.AddrPort, err error) {
+	n, addr, _, err = q.ReadFromEx(p)
+	return n, addr, err
+}
+
+// ReadFromEx is like ReadFrom but also returns the metadata of the packet.
+func (q *quicStreamPacketConn) ReadFromEx(p []byte) (n int, addr netip.AddrPort, meta ReadMeta, err error) {
 	q.mu.Lock()
-	defer q.mu.Unlock()
-	if q.incomingPackets != nil {
+	incomingPackets := q.incomingPackets
+	q.mu.Unlock()
+	if incomingPackets != nil {
+		q.muRead.Lock()
+		defer q.muRead.Unlock()
+		deadline := q.readDeadlineChan()
 		for {
-			packet, closed := q.incomingPackets.PopFrontBlock()
+			packet, closed, timeout := incomingPackets.PopFrontDeadline(deadline)
+			if timeout {
+				// Partially reassembled packets stay in deFragger.
+				err = os.ErrDeadlineExceeded
+				return
+			}
 			if closed {
-				err = net.ErrClosed
+				err = q.closedError()
 				return
 			}
-			_d, _ := q.deFraggers.LoadOrStore(packet.PKT_ID, &deFragger{})
-			d := _d.(*deFragger)
 			var assembled bool
-			// Feed packet into this deFragger.
-			// Return if this PKT_ID is ready and assembled.
-			if n, addr, assembled = d.Feed(packet, p); assembled {
-				q.deFraggers.Delete(packet.PKT_ID)
+			if n, addr, meta.ReassemblyTime, assembled = q.deFragger.Feed(packet, p); assembled {
+				meta.PktId = packet.PKT_ID
+				q.recvSeq++
+				meta.RecvSeq = q.recvSeq
+				atomic.AddUint64(&q.rxBytes, uint64(n))
+				q.rxRate.Add(n, time.Now())
 				return
-			} else {
-				// FIXME: Timeout to clean deFraggers.
 			}
 		}
 	} else {
-		err = net.ErrClosed
+		err = q.closedError()
 	}
 	return
 }
 
+// Flush returns once every packet being reassembled is either completed by
+// readers or evicted after ReassemblyTimeout, or ctx is done.
+func (q *quicStreamPacketConn) Flush(ctx context.Context) error {
+	return q.deFragger.Flush(ctx)
+}
+
+// FragmentsDropped returns the number of fragments dropped from reassembly.
+func (q *quicStreamPacketConn) FragmentsDropped() uint64 {
+	return q.deFragger.Stats().Dropped
+}
+
+// StreamCloseErrors returns the number of packets in QUIC relay mode whose
+// stream fails to close, which may not have been delivered.
+func (q *quicStreamPacketConn) StreamCloseErrors() uint64 {
+	return atomic.LoadUint64(&q.streamCloseErrors)
+}
+
 func (q *quicStreamPacketConn) WriteTo(p []byte, addr string) (n int, err error) {
+	return q.writeTo(p, addr, q.nextPktId(), false, false)
+}
+
+// WriteToPktId is like WriteTo but sends p with the given PKT_ID, so that the
+// caller can correlate it. It returns ErrPktIdInUse if pktId has been passed
+// to WriteToPktId within ReassemblyTimeout, during which the peer may still be
+// reassembling the previous packet of it. WriteTo skips the PKT_IDs reserved
+// this way, but those it chose itself are not checked. If a fragment of p turns out too large once others are sent, the
+// error is returned rather than p re-sent under another PKT_ID.
+func (q *quicStreamPacketConn) WriteToPktId(p []byte, addr string, pktId uint16) (n int, err error) {
+	if err = q.reservePktId(pktId, time.Now()); err != nil {
+		return 0, newWriteDropError(err)
+	}
+	if n, err = q.writeTo(p, addr, pktId, true, false); err != nil {
+		q.releasePktId(pktId)
+	}
+	return n, err
+}
+
+// WriteToAck is like WriteTo but returns only once p is handed to QUIC in
+// full, for packets the caller needs to know the fate of. In QUIC relay mode p
+// is sent on a uni-stream of its own, even if streams are kept per target, and
+// WriteToAck returns once the stream is closed cleanly; otherwise it returns
+// once SendMessage accepts every datagram of p. quic-go reports neither when
+// the data leaves it nor when the peer acknowledges it, so that is not waited
+// for.
+func (q *quicStreamPacketConn) WriteToAck(p []byte, addr string) error {
+	_, err := q.writeTo(p, addr, q.nextPktId(), false, true)
+	return err
+}
+
+func (q *quicStreamPacketConn) reservePktId(pktId uint16, now time.Time) error {
+	q.muPktId.Lock()
+	defer q.muPktId.Unlock()
+	if q.pktIdsInUse == nil {
+		q.pktIdsInUse = make(map[uint16]time.Time)
+	}
+	if now.Sub(q.lastPktIdSweep) >= ReassemblyTimeout {
+		q.lastPktIdSweep = now
+		for id, sentAt := range q.pktIdsInUse {
+			if now.Sub(sentAt) >= ReassemblyTimeout {
+				delete(q.pktIdsInUse, id)
+			}
+		}
+	}
+	if sentAt, ok := q.pktIdsInUse[pktId]; ok && now.Sub(sentAt) < ReassemblyTimeout {
+		return fmt.Errorf("%w: %v", ErrPktIdInUse, pktId)
+	}
+	q.pktIdsInUse[pktId] = now
+	return nil
+}
+
+func (q *quicStreamPacketConn) releasePktId(pktId uint16) {
+	q.muPktId.Lock()
+	defer q.muPktId.Unlock()
+	delete(q.pktIdsInUse, pktId)
+}
+
+// writeTo sends p to addr with pktId. If pinned is set, pktId is chosen by the
+// caller and never replaced. If ack is set, targetStreams is not used, as
+// WriteToAck describes.
+func (q *quicStreamPacketConn) writeTo(p []byte, addr string, pktId uint16, pinned bool, ack bool) (n int, err error) {
+	defer func() {
+		err = newWriteDropError(err)
+	}()
 	if len(p) > 0xffff { // uint16 max
 		return 0, quic.ErrMessageTooLarge(0xffff)
 	}
 	if q.closed {
-		return 0, net.ErrClosed
+		return 0, q.closedError()
+	}
+	deadline := q.writeDeadlineAt(time.Now())
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
 	}
+	sessionConn, targetStreams := q.conn()
 	if q.deferQuicConnFn != nil {
 		defer func() {
-			q.deferQuicConnFn(q.quicConn, err)
+			// Let it tell dropped packets from broken connections.
+			q.deferQuicConnFn(sessionConn, newWriteDropError(err))
 		}()
 	}
-	buf := pool.GetBuffer()
-	defer pool.PutBuffer(buf)
-	mdata, err := protocol.ParseMetadata(addr)
+	defer func() {
+		if err != nil && sessionConn.Context().Err() != nil {
+			err = q.closedError()
+		}
+	}()
+	address, err := q.address(addr)
 	if err != nil {
-		return 0, err
+		return 0, &WriteDropError{Reason: WriteDropBadTarget, Err: err}
 	}
-	address := NewAddress(&mdata)
-	pktId := uint16(fastrand.Uint32())
+	codec := q.packetCodec()
 	packet := NewPacket(q.connId, pktId, 1, 0, uint16(len(p)), address, p, Ver5)
+	// Fragments and padding take up to a datagram.
+	bufSize := packet.BytesLen()
+	if datagramSize := q.maxPacketSize() + PacketOverHead; bufSize < datagramSize {
+		bufSize = datagramSize
+	}
+	buf, putBuffer := q.getBuffer(bufSize)
+	defer putBuffer()
 	switch q.udpRelayMode {
 	case common.QUIC:
-		err = packet.WriteTo(buf)
+		err = codec.Encode(buf, packet)
 		if err != nil {
 			return
 		}
+		if targetStreams != nil && !ack {
+			err = targetStreams.Write(sessionConn, addr, buf.Bytes())
+			if err != nil {
+				return
+			}
+			break
+		}
 		var stream quic.SendStream
-		stream, err = q.quicConn.OpenUniStream()
+		stream, err = sessionConn.OpenUniStream()
 		if err != nil {
 			return
 		}
-		defer stream.Close()
+		if !deadline.IsZero() {
+			_ = stream.SetWriteDeadline(deadline)
+		}
 		_, err = buf.WriteTo(stream)
+		// A failed close may leave the packet not fully flushed.
+		if closeErr := stream.Close(); closeErr != nil {
+			atomic.AddUint64(&q.streamCloseErrors, 1)
+			if err == nil {
+				err = closeErr
+			}
+		}
 		if err != nil {
 			return
 		}
 	default: // native
-		if len(p) > q.maxUdpRelayPacketSize {
-			err = fragWriteNative(q.quicConn, packet, buf, q.maxUdpRelayPacketSize)
-			if err != nil {
-				return
-			}
+		quicConn := sessionConn
+		if !deadline.IsZero() {
+			quicConn = &deadlineQuicConn{Connection: sessionConn, deadline: deadline, pc: q}
+		}
+		maxPacketSize := q.maxPacketSizeTo(address)
+		sent := 0
+		if len(p) > maxPacketSize {
+			sent, err = fragWriteNative(quicConn, codec, packet, buf, maxPacketSize+PacketOverHead, q.padMultiple)
 		} else {
-			err = packet.WriteTo(buf)
+			err = codec.Encode(buf, packet)
 			if err != nil {
 				return
 			}
+			padDatagram(buf, q.padMultiple, maxPacketSize+PacketOverHead)
 			data := buf.Bytes()
-			err = q.quicConn.SendMessage(data)
+			err = quicConn.SendMessage(data)
 		}
 		var tooLarge quic.ErrMessageTooLarge
-		if errors.As(err, &tooLarge) {
-			err = fragWriteNative(q.quicConn, packet, buf, int(tooLarge)-PacketOverHead)
+		if errors.As(err, &tooLarge) && int(tooLarge) < maxPacketSize+PacketOverHead {
+			// Remember it so that following packets are fragmented up front.
+			// A limit not below the one used means too many fragments, which
+			// a retry cannot fix.
+			q.lowerMaxPacketSize(int(tooLarge) - PacketOverHead)
+			if sent > 0 {
+				// The peer rejects fragments of a different FRAG_TOTAL
+				// under the PKT_ID of the fragments it holds.
+				if pinned {
+					return
+				}
+				packet.PKT_ID = q.nextPktId()
+			}
+			_, err = fragWriteNative(quicConn, codec, packet, buf, int(tooLarge), q.padMultiple)
 		}
 		if err != nil {
 			return
 		}
 	}
 	n = len(p)
+	atomic.AddUint64(&q.txBytes, uint64(n))
+	q.txRate.Add(n, time.Now())
 
 	return
 }
 
+func (q *quicStreamPacketConn) packetCodec() PacketCodec {
+	if q.codec == nil {
+		return DefaultPacketCodec
+	}
+	return q.codec
+}
+
+// fixedTarget is the target of Write with its Address, which is shared and
+// must not be modified.
+type fixedTarget struct {
+	addr    string
+	address *Address
+}
+
+// SetTarget makes addr the target of Write. Its Address is parsed once and
+// used by Write, and by WriteTo to addr, until the target is set again.
+func (q *quicStreamPacketConn) SetTarget(addr string) error {
+	mdata, err := protocol.ParseMetadata(addr)
+	if err != nil {
+		return err
+	}
+	q.fixed.Store(&fixedTarget{addr: addr, address: NewAddress(&mdata)})
+	return nil
+}
+
+// writeTarget returns the target of Write.
+func (q *quicStreamPacketConn) writeTarget() string {
+	if fixed, ok := q.fixed.Load().(*fixedTarget); ok {
+		return fixed.addr
+	}
+	return q.target
+}
+
+func (q *quicStreamPacketConn) address(addr string) (*Address, error) {
+	if fixed, ok := q.fixed.Load().(*fixedTarget); ok && fixed.addr == addr {
+		return fixed.address, nil
+	}
+	if q.addressCache != nil {
+		return q.addressCache.Get(addr)
+	}
+	mdata, err := protocol.ParseMetadata(addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewAddress(&mdata), nil
+}
+
+// maxPacketSize returns the max payload size of a datagram without fragmentation.
+func (q *quicStreamPacketConn) maxPacketSize() int {
+	if ceil := int(atomic.LoadInt64(&q.maxPacketSizeCeil)); ceil > 0 && ceil < q.maxUdpRelayPacketSize {
+		return ceil
+	}
+	return q.maxUdpRelayPacketSize
+}
+
+func (q *quicStreamPacketConn) lowerMaxPacketSize(size int) {
+	if size < 1 {
+		size = 1
+	}
+	for {
+		ceil := atomic.LoadInt64(&q.maxPacketSizeCeil)
+		if ceil > 0 && ceil <= int64(size) {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&q.maxPacketSizeCeil, ceil, int64(size)) {
+			return
+		}
+	}
+}
+
+// nextPktId returns the PKT_ID for the next packet, skipping those WriteToPktId
+// has reserved. Sequential ids wrap around at 0xffff.
+func (q *quicStreamPacketConn) nextPktId() uint16 {
+	q.muPktId.Lock()
+	defer q.muPktId.Unlock()
+	if len(q.pktIdsInUse) == 0 {
+		return q.drawPktId()
+	}
+	now := time.Now()
+	for i := 0; ; i++ {
+		pktId := q.drawPktId()
+		sentAt, ok := q.pktIdsInUse[pktId]
+		// Every id may be reserved in theory; give up after as many draws.
+		if !ok || now.Sub(sentAt) >= ReassemblyTimeout || i == 0xffff {
+			return pktId
+		}
+	}
+}
+
+func (q *quicStreamPacketConn) drawPktId() uint16 {
+	if q.sequentialPktId {
+		return uint16(atomic.AddUint32(&q.pktIdCounter, 1))
+	}
+	return uint16(fastrand.Uint32())
+}
+
 func (q *quicStreamPacketConn) LocalAddr() net.Addr {
-	return q.quicConn.LocalAddr()
+	quicConn, _ := q.conn()
+	return quicConn.LocalAddr()
 }
 
 func (conn *quicStreamPacketConn) Read(b []byte) (n int, err error) {
@@ -274,7 +920,7 @@ func (conn *quicStreamPacketConn) Read(b []byte) (n int, err error) {
 }
 
 func (conn *quicStreamPacketConn) Write(b []byte) (n int, err error) {
-	return conn.WriteTo(b, conn.target)
+	return conn.WriteTo(b, conn.writeTarget())
 }
 
 var _ netproxy.PacketConn = (*quicStreamPacketConn)(nil)
@@ -0,0 +1,83 @@
+package tuic
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrNotPacket is returned by PacketReader if a command other than Packet
+	// is read.
+	ErrNotPacket = errors.New("not a packet command")
+	// ErrPacketTooLarge is returned by PacketReader if a packet carries more
+	// data than its max size.
+	ErrPacketTooLarge = errors.New("packet too large")
+)
+
+// PacketReader decodes a stream of TUIC Packet commands, such as a uni-stream
+// in QUIC relay mode or a UDP-over-TCP relay, from any io.Reader.
+type PacketReader struct {
+	reader  BufferedReader
+	codec   PacketCodec
+	maxSize int
+}
+
+// NewPacketReader returns a PacketReader reading from r with codec, or
+// DefaultPacketCodec if codec is nil. Packets carrying more than maxSize
+// bytes of data are rejected unless maxSize is 0; DefaultPacketCodec rejects
+// them before reading the data.
+func NewPacketReader(r io.Reader, codec PacketCodec, maxSize int) *PacketReader {
+	reader, ok := r.(BufferedReader)
+	if !ok {
+		reader = bufio.NewReader(r)
+	}
+	if codec == nil {
+		codec = DefaultPacketCodec
+	}
+	return &PacketReader{
+		reader:  reader,
+		codec:   codec,
+		maxSize: maxSize,
+	}
+}
+
+// ReadPacket reads the next packet. It returns io.EOF if the stream ends
+// between packets, and io.ErrUnexpectedEOF if it ends within one.
+func (r *PacketReader) ReadPacket() (*Packet, error) {
+	// Read the command head by hand to tell the end of the stream from a
+	// truncated head.
+	ver, err := r.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	typ, err := r.reader.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	head := &CommandHead{VER: ver, TYPE: CommandType(typ)}
+	if head.TYPE != PacketType {
+		return nil, fmt.Errorf("%w: %v", ErrNotPacket, head.TYPE)
+	}
+	var packet *Packet
+	if decoder, ok := r.codec.(limitedDecoder); ok && r.maxSize > 0 {
+		packet, err = decoder.decodeLimited(head, r.reader, r.maxSize)
+	} else {
+		packet, err = r.codec.Decode(head, r.reader)
+	}
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if r.maxSize > 0 && len(packet.DATA) > r.maxSize {
+		return nil, fmt.Errorf("%w: %v > %v", ErrPacketTooLarge, len(packet.DATA), r.maxSize)
+	}
+	return packet, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
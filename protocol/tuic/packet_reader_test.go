@@ -0,0 +1,84 @@
+package tuic
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+)
+
+func encodeTestPackets(t *testing.T, payloads ...string) []byte {
+	buf := new(bytes.Buffer)
+	address := NewAddressAddrPort(netip.MustParseAddrPort("127.0.0.1:53"))
+	for i, payload := range payloads {
+		packet := NewPacket(1, uint16(i), 1, 0, uint16(len(payload)), address, []byte(payload), Ver5)
+		if err := packet.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestPacketReader(t *testing.T) {
+	payloads := []string{"first", "second", "third"}
+	stream := encodeTestPackets(t, payloads...)
+	tail := encodeTestPackets(t, "truncated")
+
+	// A plain io.Reader is buffered by the PacketReader.
+	reader := NewPacketReader(io.MultiReader(bytes.NewReader(stream), bytes.NewReader(tail[:len(tail)-3])), nil, 0)
+	for i, payload := range payloads {
+		packet, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.PKT_ID != uint16(i) || string(packet.DATA) != payload || packet.ADDR.UDPAddr().String() != "127.0.0.1:53" {
+			t.Fatal("unexpected packet", packet.PKT_ID, string(packet.DATA))
+		}
+	}
+	if _, err := reader.ReadPacket(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal("expected unexpected EOF, got", err)
+	}
+
+	// The stream may end between packets only.
+	reader = NewPacketReader(bytes.NewReader(stream), nil, 0)
+	for range payloads {
+		if _, err := reader.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := reader.ReadPacket(); err != io.EOF {
+		t.Fatal("expected EOF, got", err)
+	}
+	for _, n := range []int{1, 2} {
+		reader = NewPacketReader(bytes.NewReader(tail[:n]), nil, 0)
+		if _, err := reader.ReadPacket(); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatal(n, "expected unexpected EOF, got", err)
+		}
+	}
+}
+
+func TestPacketReaderGuards(t *testing.T) {
+	reader := NewPacketReader(bytes.NewReader(encodeTestPackets(t, "short", "too long")), nil, 5)
+	if _, err := reader.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadPacket(); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatal("expected too large, got", err)
+	}
+	// The size is checked before the data is read.
+	tooLong := encodeTestPackets(t, "too long")
+	reader = NewPacketReader(bytes.NewReader(tooLong[:len(tooLong)-len("too long")]), nil, 5)
+	if _, err := reader.ReadPacket(); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatal("expected too large, got", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := NewHeartbeat(Ver5).WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	reader = NewPacketReader(buf, nil, 0)
+	if _, err := reader.ReadPacket(); !errors.Is(err, ErrNotPacket) {
+		t.Fatal("expected not a packet, got", err)
+	}
+}
@@ -0,0 +1,869 @@
+package tuic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/softwind/protocol/tuic/common"
+	"github.com/mzz2017/quic-go"
+)
+
+// fakeQuicConn records datagrams sent by SendMessage. Methods not overridden
+// panic through the nil embedded interface.
+type fakeQuicConn struct {
+	quic.Connection
+
+	mu         sync.Mutex
+	messages   [][]byte
+	uniStreams []*fakeSendStream
+	// streamCloseErr is returned by Close of the streams opened.
+	streamCloseErr error
+	// streamCloseDelay slows down Close of the streams opened.
+	streamCloseDelay time.Duration
+
+	// ctx is context.Background() if nil.
+	ctx context.Context
+	// maxDatagramSize makes SendMessage reject larger datagrams if positive.
+	maxDatagramSize int
+	rejected        int
+	closed          bool
+	// sendErrs are returned by the following SendMessage calls in order.
+	sendErrs  []error
+	sendCalls int
+	// incoming feeds ReceiveMessage.
+	incoming chan []byte
+	// incomingStreams feeds AcceptUniStream.
+	incomingStreams chan quic.ReceiveStream
+	// sendDelay slows down each SendMessage.
+	sendDelay time.Duration
+	state     quic.ConnectionState
+}
+
+func (c *fakeQuicConn) ConnectionState() quic.ConnectionState {
+	return c.state
+}
+
+func (c *fakeQuicConn) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+type fakeSendStream struct {
+	quic.SendStream
+
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+	// closeErr is returned by Close.
+	closeErr error
+	// closeDelay slows down Close.
+	closeDelay time.Duration
+}
+
+func (s *fakeSendStream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(b)
+}
+
+func (s *fakeSendStream) Close() error {
+	time.Sleep(s.closeDelay)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return s.closeErr
+}
+
+func (s *fakeSendStream) CancelWrite(quic.StreamErrorCode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
+
+func (c *fakeQuicConn) OpenUniStream() (quic.SendStream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stream := &fakeSendStream{closeErr: c.streamCloseErr, closeDelay: c.streamCloseDelay}
+	c.uniStreams = append(c.uniStreams, stream)
+	return stream, nil
+}
+
+func (c *fakeQuicConn) CloseWithError(quic.ApplicationErrorCode, string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeQuicConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *fakeQuicConn) SendMessage(b []byte) error {
+	time.Sleep(c.sendDelay)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendCalls++
+	if len(c.sendErrs) > 0 {
+		err := c.sendErrs[0]
+		c.sendErrs = c.sendErrs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	if c.maxDatagramSize > 0 && len(b) > c.maxDatagramSize {
+		c.rejected++
+		return quic.ErrMessageTooLarge(c.maxDatagramSize)
+	}
+	c.messages = append(c.messages, append([]byte(nil), b...))
+	return nil
+}
+
+func (c *fakeQuicConn) ReceiveMessage(ctx context.Context) ([]byte, error) {
+	select {
+	case m := <-c.incoming:
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *fakeQuicConn) AcceptUniStream(ctx context.Context) (quic.ReceiveStream, error) {
+	select {
+	case s := <-c.incomingStreams:
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fakeReceiveStream reads from reader and closes canceled on CancelRead.
+type fakeReceiveStream struct {
+	quic.ReceiveStream
+
+	reader   io.Reader
+	canceled chan struct{}
+}
+
+func (s *fakeReceiveStream) Read(b []byte) (int, error) {
+	return s.reader.Read(b)
+}
+
+func (s *fakeReceiveStream) CancelRead(quic.StreamErrorCode) {
+	close(s.canceled)
+}
+
+func (c *fakeQuicConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+}
+
+func (c *fakeQuicConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}
+}
+
+func (c *fakeQuicConn) sentPackets(t *testing.T) []*Packet {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	packets := make([]*Packet, 0, len(c.messages))
+	for _, m := range c.messages {
+		packet, err := ReadPacket(bytes.NewReader(m))
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+func newTestPacketConn(quicConn quic.Connection) *quicStreamPacketConn {
+	return &quicStreamPacketConn{
+		connId:                1,
+		quicConn:              quicConn,
+		incomingPackets:       NewPackets(),
+		udpRelayMode:          common.NATIVE,
+		maxUdpRelayPacketSize: 1400,
+	}
+}
+
+func TestSetTarget(t *testing.T) {
+	quicConn := &fakeQuicConn{}
+	pc := newTestPacketConn(quicConn)
+	pc.target = "127.0.0.1:53"
+	if err := pc.SetTarget("127.0.0.2:53"); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := pc.address("127.0.0.2:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writes to the target do not parse it again.
+	var reused bool
+	if allocs := testing.AllocsPerRun(100, func() {
+		address, _ := pc.address(pc.writeTarget())
+		reused = address == cached
+	}); allocs != 0 || !reused {
+		t.Fatal("the target is parsed again", allocs, reused)
+	}
+	if _, err = pc.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pc.WriteTo([]byte("hello"), "127.0.0.2:53"); err != nil {
+		t.Fatal(err)
+	}
+	// Changing the target invalidates the cache.
+	if err = pc.SetTarget("127.0.0.3:53"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pc.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if address, _ := pc.address("127.0.0.2:53"); address == cached {
+		t.Fatal("the previous target is still cached")
+	}
+	if err = pc.SetTarget("bad"); err == nil {
+		t.Fatal("expected parse error")
+	}
+	if target := pc.sessionInfo(time.Now()).Target; target != "127.0.0.3:53" {
+		t.Fatal("unexpected target", target)
+	}
+	expected := []string{"127.0.0.2:53", "127.0.0.2:53", "127.0.0.3:53"}
+	packets := quicConn.sentPackets(t)
+	if len(packets) != len(expected) {
+		t.Fatal("unexpected packets", len(packets))
+	}
+	for i, packet := range packets {
+		if addr := packet.ADDR.UDPAddr().String(); addr != expected[i] {
+			t.Fatal(i, addr, "!=", expected[i])
+		}
+	}
+}
+
+func TestSequentialPktId(t *testing.T) {
+	quicConn := &fakeQuicConn{}
+	pc := newTestPacketConn(quicConn)
+	pc.sequentialPktId = true
+	pc.pktIdCounter = 0xfffe
+	for i := 0; i < 4; i++ {
+		if _, err := pc.WriteTo([]byte("hello"), "127.0.0.1:53"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	packets := quicConn.sentPackets(t)
+	expected := []uint16{0xffff, 0, 1, 2}
+	for i, packet := range packets {
+		if packet.PKT_ID != expected[i] {
+			t.Fatal(i, packet.PKT_ID, "!=", expected[i])
+		}
+	}
+}
+
+func TestWriteToPktId(t *testing.T) {
+	quicConn := &fakeQuicConn{}
+	pc := newTestPacketConn(quicConn)
+	if _, err := pc.WriteToPktId([]byte("hello"), "127.0.0.1:53", 0x1234); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.WriteToPktId([]byte("hello"), "127.0.0.1:53", 0x1234); !errors.Is(err, ErrPktIdInUse) {
+		t.Fatal(err)
+	}
+	if _, err := pc.WriteToPktId([]byte("hello"), "127.0.0.1:53", 0x1235); err != nil {
+		t.Fatal(err)
+	}
+	// The id is free again once the peer cannot be reassembling it anymore.
+	pc.pktIdsInUse[0x1234] = time.Now().Add(-ReassemblyTimeout)
+	if _, err := pc.WriteToPktId([]byte("hello"), "127.0.0.1:53", 0x1234); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := quicConn.sentPackets(t)
+	expected := []uint16{0x1234, 0x1235, 0x1234}
+	if len(packets) != len(expected) {
+		t.Fatal(len(packets))
+	}
+	for i, packet := range packets {
+		if packet.PKT_ID != expected[i] {
+			t.Fatal(i, packet.PKT_ID, "!=", expected[i])
+		}
+	}
+	pc.incomingPackets.PushBack(packets[0])
+	buf := make([]byte, 16)
+	n, _, meta, err := pc.ReadFromEx(buf)
+	if err != nil || string(buf[:n]) != "hello" || meta.PktId != 0x1234 {
+		t.Fatal(string(buf[:n]), meta.PktId, err)
+	}
+}
+
+func TestPktIdSkipsReserved(t *testing.T) {
+	quicConn := &fakeQuicConn{}
+	pc := newTestPacketConn(quicConn)
+	pc.sequentialPktId = true
+	if _, err := pc.WriteToPktId([]byte("hello"), "127.0.0.1:53", 1); err != nil {
+		t.Fatal(err)
+	}
+	// The expired reservation of 3 no longer matters.
+	pc.pktIdsInUse[3] = time.Now().Add(-ReassemblyTimeout)
+	for i := 0; i < 2; i++ {
+		if _, err := pc.WriteTo([]byte("hello"), "127.0.0.1:53"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pc.WriteToAck([]byte("hello"), "127.0.0.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	packets := quicConn.sentPackets(t)
+	expected := []uint16{1, 2, 3, 4}
+	if len(packets) != len(expected) {
+		t.Fatal(len(packets))
+	}
+	for i, packet := range packets {
+		if packet.PKT_ID != expected[i] {
+			t.Fatal(i, packet.PKT_ID, "!=", expected[i])
+		}
+	}
+}
+
+func TestRandomPktId(t *testing.T) {
+	quicConn := &fakeQuicConn{}
+	pc := newTestPacketConn(quicConn)
+	for i := 0; i < 16; i++ {
+		if _, err := pc.WriteTo([]byte("hello"), "127.0.0.1:53"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := make(map[uint16]struct{})
+	for _, packet := range quicConn.sentPackets(t) {
+		ids[packet.PKT_ID] = struct{}{}
+	}
+	if len(ids) == 1 {
+		t.Fatal("random pktIds do not vary")
+	}
+}
+
+func TestPadMultiple(t *testing.T) {
+	quicConn := &fakeQuicConn{}
+	pc := newTestPacketConn(quicConn)
+	pc.padMultiple = 128
+	query := make([]byte, 45) // a typical DNS query
+	for i := range query {
+		query[i] = byte(i)
+	}
+	if _, err := pc.WriteTo(query, "8.8.8.8:53"); err != nil {
+		t.Fatal(err)
+	}
+	// A payload near the MTU can only be padded up to the datagram limit.
+	large := make([]byte, pc.maxUdpRelayPacketSize)
+	if _, err := pc.WriteTo(large, "8.8.8.8:53"); err != nil {
+		t.Fatal(err)
+	}
+	if len(quicConn.messages) != 2 {
+		t.Fatal("unexpected datagram count", len(quicConn.messages))
+	}
+	if len(quicConn.messages[0])%128 != 0 {
+		t.Fatal("datagram is not padded", len(quicConn.messages[0]))
+	}
+	if len(quicConn.messages[1]) > pc.maxUdpRelayPacketSize+PacketOverHead {
+		t.Fatal("padding exceeds the datagram limit", len(quicConn.messages[1]))
+	}
+	packets := quicConn.sentPackets(t)
+	if !bytes.Equal(packets[0].DATA, query) || len(packets[1].DATA) != len(large) {
+		t.Fatal("payload is not preserved")
+	}
+}
+
+func TestStreamCloseError(t *testing.T) {
+	closeErr := errors.New("close failed")
+	quicConn := &fakeQuicConn{streamCloseErr: closeErr}
+	pc := newTestPacketConn(quicConn)
+	pc.udpRelayMode = common.QUIC
+	if _, err := pc.WriteTo([]byte("hello"), "127.0.0.1:53"); !errors.Is(err, closeErr) {
+		t.Fatal(err)
+	}
+	if pc.StreamCloseErrors() != 1 {
+		t.Fatal(pc.StreamCloseErrors())
+	}
+
+	quicConn.streamCloseErr = nil
+	if _, err := pc.WriteTo([]byte("hello"), "127.0.0.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	if pc.StreamCloseErrors() != 1 {
+		t.Fatal(pc.StreamCloseErrors())
+	}
+}
+
+func TestWriteToAck(t *testing.T) {
+	quicConn := &fakeQuicConn{streamCloseDelay: 50 * time.Millisecond}
+	pc := newTestPacketConn(quicConn)
+	pc.udpRelayMode = common.QUIC
+	pc.targetStreams = newTargetStreams(4)
+	if _, err := pc.WriteTo([]byte("hello"), "127.0.0.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := pc.WriteToAck([]byte("critical"), "127.0.0.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	// The packet is not left on the stream of the target.
+	quicConn.mu.Lock()
+	if len(quicConn.uniStreams) != 2 {
+		t.Fatal("unexpected streams", len(quicConn.uniStreams))
+	}
+	stream := quicConn.uniStreams[1]
+	quicConn.mu.Unlock()
+	stream.mu.Lock()
+	closed, written := stream.closed, append([]byte(nil), stream.buf.Bytes()...)
+	stream.mu.Unlock()
+	if !closed || time.Since(start) < quicConn.streamCloseDelay {
+		t.Fatal("returned before the stream is closed")
+	}
+	packet, err := ReadPacket(bytes.NewReader(written))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(packet.DATA) != "critical" {
+		t.Fatal("unexpected data", string(packet.DATA))
+	}
+
+	closeErr := errors.New("close failed")
+	quicConn.streamCloseErr = closeErr
+	if err = pc.WriteToAck([]byte("critical"), "127.0.0.1:53"); !errors.Is(err, closeErr) {
+		t.Fatal(err)
+	}
+
+	// In native mode, the error of SendMessage is returned.
+	sendErr := errors.New("send failed")
+	quicConn = &fakeQuicConn{sendErrs: []error{sendErr}}
+	pc = newTestPacketConn(quicConn)
+	if err = pc.WriteToAck([]byte("critical"), "127.0.0.1:53"); !errors.Is(err, sendErr) {
+		t.Fatal(err)
+	}
+	if err = pc.WriteToAck([]byte("critical"), "127.0.0.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	if packets := quicConn.sentPackets(t); len(packets) != 1 || string(packets[0].DATA) != "critical" {
+		t.Fatal("unexpected packets", packets)
+	}
+}
+
+func TestDefaultWriteTimeout(t *testing.T) {
+	quicConn := &fakeQuicConn{sendDelay: 300 * time.Millisecond}
+	pc := newTestPacketConn(quicConn)
+	pc.defaultWriteTimeout = 20 * time.Millisecond
+	start := time.Now()
+	if _, err := pc.WriteTo([]byte("hello"), "127.0.0.1:53"); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Fatal("write took", elapsed)
+	}
+
+	// An explicit deadline overrides the default timeout.
+	if err := pc.SetWriteDeadline(time.Now().Add(3 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.WriteTo([]byte("hello"), "127.0.0.1:53"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStalledSendsShareGoroutine(t *testing.T) {
+	quicConn := &fakeQuicConn{sendDelay: 300 * time.Millisecond}
+	pc := newTestPacketConn(quicConn)
+	pc.defaultWriteTimeout = 5 * time.Millisecond
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		if _, err := pc.WriteTo([]byte("hello"), "127.0.0.1:53"); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal(err)
+		}
+	}
+	// Only the first send is left running, and the others wait for it.
+	if n := runtime.NumGoroutine(); n > before+1 {
+		t.Fatal("sends pile up goroutines:", n-before)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatal("the stalled send is left running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The connection is usable once the stalled send returns.
+	pc.defaultWriteTimeout = time.Second
+	if _, err := pc.WriteTo([]byte("hello"), "127.0.0.1:53"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkWriteToDeadline(b *testing.B) {
+	quicConn := &fakeQuicConn{}
+	pc := newTestPacketConn(quicConn)
+	if err := pc.SetWriteDeadline(time.Now().Add(time.Hour)); err != nil {
+		b.Fatal(err)
+	}
+	payload := make([]byte, 1200)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := pc.WriteTo(payload, "127.0.0.1:53"); err != nil {
+			b.Fatal(err)
+		}
+		quicConn.mu.Lock()
+		quicConn.messages = quicConn.messages[:0]
+		quicConn.mu.Unlock()
+	}
+}
+
+func TestWriteDropError(t *testing.T) {
+	expectDrop := func(name string, err error, reason WriteDropReason) {
+		var dropErr *WriteDropError
+		if !errors.As(err, &dropErr) || dropErr.Reason != reason {
+			t.Fatal(name, "unexpected error", err)
+		}
+	}
+	pc := newTestPacketConn(&fakeQuicConn{})
+	_, err := pc.WriteTo(make([]byte, 0x10000), "127.0.0.1:53")
+	expectDrop("oversized", err, WriteDropTooLarge)
+	_, err = pc.WriteTo([]byte("hello"), "bad")
+	expectDrop("bad target", err, WriteDropBadTarget)
+	if _, err = pc.WriteToPktId([]byte("hello"), "127.0.0.1:53", 1); err != nil {
+		t.Fatal(err)
+	}
+	_, err = pc.WriteToPktId([]byte("hello"), "127.0.0.1:53", 1)
+	expectDrop("PKT_ID in use", err, WriteDropPktIdInUse)
+	if !errors.Is(err, ErrPktIdInUse) {
+		t.Fatal(err)
+	}
+
+	// Too many fragments.
+	pc.maxUdpRelayPacketSize = 16
+	_, err = pc.WriteTo(make([]byte, 0xffff), "127.0.0.1:53")
+	expectDrop("too many fragments", err, WriteDropTooLarge)
+	pc.maxUdpRelayPacketSize = 1400
+
+	if err = pc.SetWriteDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = pc.WriteTo([]byte("hello"), "127.0.0.1:53")
+	expectDrop("expired", err, WriteDropExpired)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal(err)
+	}
+	if err = pc.SetWriteDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = pc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = pc.WriteTo([]byte("hello"), "127.0.0.1:53")
+	expectDrop("closed", err, WriteDropClosed)
+	if !errors.Is(err, net.ErrClosed) || !errors.Is(err, ErrLocalClose) {
+		t.Fatal(err)
+	}
+
+	// Other errors of the connection are returned as they are.
+	sendErr := errors.New("send failed")
+	pc = newTestPacketConn(&fakeQuicConn{sendErrs: []error{sendErr}})
+	if _, err = pc.WriteTo([]byte("hello"), "127.0.0.1:53"); err != sendErr {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalCloseError(t *testing.T) {
+	pc := newTestPacketConn(&fakeQuicConn{})
+	if err := pc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := pc.WriteTo([]byte("hello"), "127.0.0.1:53")
+	if !errors.Is(err, ErrLocalClose) || !errors.Is(err, net.ErrClosed) || errors.Is(err, ErrPeerClose) {
+		t.Fatal(err)
+	}
+	_, _, err = pc.ReadFrom(make([]byte, 16))
+	if !errors.Is(err, ErrLocalClose) || !errors.Is(err, net.ErrClosed) {
+		t.Fatal(err)
+	}
+}
+
+func TestPeerCloseError(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(&quic.ApplicationError{Remote: true, ErrorCode: 0x10, ErrorMessage: "bye"})
+	pc := newTestPacketConn(&fakeQuicConn{ctx: ctx})
+	// The client closes incoming packets of all sessions once the connection is gone.
+	_ = pc.incomingPackets.Close()
+	_, _, err := pc.ReadFrom(make([]byte, 16))
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || !errors.Is(err, ErrPeerClose) || !errors.Is(err, net.ErrClosed) {
+		t.Fatal(err)
+	}
+	if closeErr.Code != 0x10 || closeErr.Reason != "bye" {
+		t.Fatal("unexpected close error", closeErr)
+	}
+}
+
+func TestLowerMaxPacketSizeOnTooLarge(t *testing.T) {
+	quicConn := &fakeQuicConn{maxDatagramSize: 1000}
+	pc := newTestPacketConn(quicConn)
+	payload := make([]byte, 1300)
+	if _, err := pc.WriteTo(payload, "1.1.1.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	if quicConn.rejected != 1 || len(quicConn.messages) != 2 {
+		t.Fatal("the packet is not re-sent fragmented", quicConn.rejected, len(quicConn.messages))
+	}
+	if pc.maxPacketSize() != 1000-PacketOverHead {
+		t.Fatal("ceiling is not lowered:", pc.maxPacketSize())
+	}
+	if _, err := pc.WriteTo(payload, "1.1.1.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	if quicConn.rejected != 1 {
+		t.Fatal("the lowered ceiling is not used")
+	}
+}
+
+func TestRefragmentOnTooLarge(t *testing.T) {
+	quicConn := &fakeQuicConn{maxDatagramSize: 1000}
+	pc := newTestPacketConn(quicConn)
+	payload := make([]byte, 2000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := pc.WriteTo(payload, "1.1.1.1:53"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if quicConn.rejected != 1 {
+		t.Fatal("the lowered ceiling is not used:", quicConn.rejected)
+	}
+	if pc.maxPacketSize() != 1000-PacketOverHead {
+		t.Fatal("ceiling is not lowered:", pc.maxPacketSize())
+	}
+	var d DeFragger
+	buf := make([]byte, len(payload))
+	assembled := 0
+	for _, packet := range quicConn.sentPackets(t) {
+		n, addr, _, ok := d.Feed(packet, buf)
+		if !ok {
+			continue
+		}
+		assembled++
+		if !bytes.Equal(buf[:n], payload) || addr.String() != "1.1.1.1:53" {
+			t.Fatal("the packet is not reassembled", n, addr)
+		}
+	}
+	if assembled != 2 {
+		t.Fatal("unexpected packets:", assembled)
+	}
+}
+
+func TestRefragmentAfterSentFragments(t *testing.T) {
+	payload := make([]byte, 2000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	// The second fragment is rejected once the first has gone out.
+	quicConn := &fakeQuicConn{sendErrs: []error{nil, quic.ErrMessageTooLarge(1000)}}
+	pc := newTestPacketConn(quicConn)
+	if _, err := pc.WriteTo(payload, "1.1.1.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	packets := quicConn.sentPackets(t)
+	if len(packets) < 2 || packets[0].PKT_ID == packets[1].PKT_ID {
+		t.Fatal("the packet is not re-sent under another PKT_ID")
+	}
+	var d DeFragger
+	buf := make([]byte, len(payload))
+	assembled := 0
+	for _, packet := range packets {
+		if n, _, _, ok := d.Feed(packet, buf); ok {
+			assembled++
+			if !bytes.Equal(buf[:n], payload) {
+				t.Fatal("the packet is not reassembled")
+			}
+		}
+	}
+	if assembled != 1 {
+		t.Fatal("unexpected packets:", assembled)
+	}
+
+	// A PKT_ID given by the caller is not replaced.
+	quicConn = &fakeQuicConn{sendErrs: []error{nil, quic.ErrMessageTooLarge(1000)}}
+	pc = newTestPacketConn(quicConn)
+	var dropErr *WriteDropError
+	if _, err := pc.WriteToPktId(payload, "1.1.1.1:53", 7); !errors.As(err, &dropErr) || dropErr.Reason != WriteDropTooLarge {
+		t.Fatal("unexpected error", err)
+	}
+	if len(quicConn.sentPackets(t)) != 1 {
+		t.Fatal("the packet is re-sent")
+	}
+}
+
+func TestReadDeadlineKeepsFragments(t *testing.T) {
+	pc := newTestPacketConn(&fakeQuicConn{})
+	frags := newTestFragments(9, []byte("hello, world"), 8)
+	pc.incomingPackets.PushBack(frags[0])
+	if err := pc.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 32)
+	if _, _, err := pc.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected deadline exceeded, got", err)
+	}
+	// The conn is still usable and the first fragment is not lost.
+	if err := pc.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	pc.incomingPackets.PushBack(frags[1])
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello, world" || addr.String() != "127.0.0.1:53" {
+		t.Fatal("unexpected packet", string(buf[:n]), addr)
+	}
+}
+
+func TestReadDeadlineExtended(t *testing.T) {
+	pc := newTestPacketConn(&fakeQuicConn{})
+	if err := pc.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := pc.ReadFrom(make([]byte, 16))
+		done <- err
+	}()
+	// Extending the deadline applies to the blocked read.
+	if err := pc.SetReadDeadline(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		t.Fatal("read returns early:", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := pc.SetReadDeadline(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal(err)
+	}
+}
+
+func TestReadDuringFragmentedWrite(t *testing.T) {
+	quicConn := &fakeQuicConn{sendDelay: 2 * time.Millisecond}
+	pc := newTestPacketConn(quicConn)
+	writeDone := make(chan error, 1)
+	go func() {
+		// About 50 fragments.
+		_, err := pc.WriteTo(make([]byte, 0xffff), "1.1.1.1:53")
+		writeDone <- err
+	}()
+	address := NewAddressAddrPort(netip.MustParseAddrPort("1.1.1.1:53"))
+	buf := make([]byte, 16)
+	for i := 0; i < 5; i++ {
+		pc.incomingPackets.PushBack(NewPacket(1, uint16(i), 1, 0, 4, address, []byte("pong"), Ver5))
+		if _, _, err := pc.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-writeDone:
+		t.Fatal("reads are blocked until the write finishes", err)
+	default:
+	}
+	if err := <-writeDone; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseDuringRead(t *testing.T) {
+	pc := newTestPacketConn(&fakeQuicConn{})
+	readDone := make(chan error, 1)
+	go func() {
+		_, _, err := pc.ReadFrom(make([]byte, 16))
+		readDone <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	closeDone := make(chan error, 1)
+	go func() {
+		closeDone <- pc.Close()
+	}()
+	select {
+	case err := <-closeDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close is blocked by a pending read")
+	}
+	if err := <-readDone; !errors.Is(err, ErrLocalClose) {
+		t.Fatal(err)
+	}
+}
+
+type countingAllocator struct {
+	mu   sync.Mutex
+	gets int
+	puts int
+	// inUse holds the buffers not put back yet.
+	inUse map[*byte]bool
+}
+
+func (a *countingAllocator) Get(n int) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.gets++
+	b := make([]byte, n)
+	if a.inUse == nil {
+		a.inUse = make(map[*byte]bool)
+	}
+	a.inUse[&b[0]] = true
+	return b
+}
+
+func (a *countingAllocator) Put(b []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.puts++
+	delete(a.inUse, &b[0])
+}
+
+func TestAllocator(t *testing.T) {
+	quicConn := &fakeQuicConn{}
+	pc := newTestPacketConn(quicConn)
+	allocator := &countingAllocator{}
+	pc.SetAllocator(allocator)
+	if _, err := pc.WriteTo([]byte("hello"), "127.0.0.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	// A fragmented packet is encoded into one buffer.
+	if _, err := pc.WriteTo(make([]byte, 4000), "127.0.0.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(quicConn.sentPackets(t)) < 4 {
+		t.Fatal("unexpected packets", len(quicConn.sentPackets(t)))
+	}
+	allocator.mu.Lock()
+	defer allocator.mu.Unlock()
+	// Two packets and the Dissociate.
+	if allocator.gets != 3 || allocator.puts != 3 || len(allocator.inUse) != 0 {
+		t.Fatal("unexpected allocations", allocator.gets, allocator.puts, len(allocator.inUse))
+	}
+}
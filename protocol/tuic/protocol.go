@@ -2,11 +2,13 @@ package tuic
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/netip"
 	"strconv"
+	"time"
 
 	"github.com/daeuniverse/softwind/protocol"
 	"github.com/google/uuid"
@@ -238,6 +240,9 @@ type Packet struct {
 	SIZE       uint16
 	ADDR       *Address
 	DATA       []byte
+
+	// receivedAt is the arrival time of an incoming packet.
+	receivedAt time.Time
 }
 
 func NewPacket(ASSOC_ID uint16, PKT_ID uint16, FRGA_TOTAL uint8, FRAG_ID uint8, SIZE uint16, ADDR *Address, DATA []byte, VER byte) *Packet {
@@ -254,6 +259,13 @@ func NewPacket(ASSOC_ID uint16, PKT_ID uint16, FRGA_TOTAL uint8, FRAG_ID uint8,
 }
 
 func ReadPacketWithHead(head *CommandHead, reader BufferedReader) (c *Packet, err error) {
+	return readPacketWithHead(head, reader, 0)
+}
+
+// readPacketWithHead is like ReadPacketWithHead but returns ErrPacketTooLarge
+// before reading the data if the packet carries more than maxSize bytes,
+// unless maxSize is 0.
+func readPacketWithHead(head *CommandHead, reader BufferedReader, maxSize int) (c *Packet, err error) {
 	var _c Packet
 	_c.CommandHead = head
 	if _c.CommandHead.TYPE != PacketType {
@@ -280,6 +292,9 @@ func ReadPacketWithHead(head *CommandHead, reader BufferedReader) (c *Packet, er
 	if err != nil {
 		return nil, err
 	}
+	if maxSize > 0 && int(_c.SIZE) > maxSize {
+		return nil, fmt.Errorf("%w: %v > %v", ErrPacketTooLarge, _c.SIZE, maxSize)
+	}
 	_c.ADDR, err = ReadAddress(reader)
 	if err != nil {
 		return nil, err
@@ -337,9 +352,12 @@ func (c Packet) WriteTo(writer BufferedWriter) (err error) {
 }
 
 func (c Packet) BytesLen() int {
-	return c.CommandHead.BytesLen() + 4 + 2 + c.ADDR.BytesLen() + len(c.DATA)
+	return c.CommandHead.BytesLen() + packetFieldsLen + c.ADDR.BytesLen() + len(c.DATA)
 }
 
+// packetFieldsLen is the length of ASSOC_ID, PKT_ID, FRAG_TOTAL, FRAG_ID and SIZE.
+const packetFieldsLen = 2 + 2 + 1 + 1 + 2
+
 var PacketOverHead = NewPacket(0, 0, 0, 0, 0, NewAddressAddrPort(netip.AddrPortFrom(netip.IPv6Unspecified(), 0)), nil, 0).BytesLen()
 
 type Dissociate struct {
@@ -428,6 +446,11 @@ const (
 	AtypNone       byte = 255 // Address type None is used in Packet commands that is not the first fragment of a UDP packet.
 )
 
+var (
+	ErrTruncatedAddress   = errors.New("truncated address")
+	ErrUnknownAddressType = errors.New("unknown address type")
+)
+
 type Address struct {
 	TYPE byte
 	ADDR []byte
@@ -502,38 +525,66 @@ func ReadAddress(reader BufferedReader) (c *Address, err error) {
 		_c.ADDR = make([]byte, net.IPv4len)
 		_, err = io.ReadFull(reader, _c.ADDR)
 		if err != nil {
-			return
+			return nil, truncatedAddressError(_c.TYPE, "addr", err)
 		}
 	case AtypIPv6:
 		_c.ADDR = make([]byte, net.IPv6len)
 		_, err = io.ReadFull(reader, _c.ADDR)
 		if err != nil {
-			return
+			return nil, truncatedAddressError(_c.TYPE, "addr", err)
 		}
 	case AtypDomainName:
 		var addrLen byte
 		addrLen, err = reader.ReadByte()
 		if err != nil {
-			return
+			return nil, truncatedAddressError(_c.TYPE, "domain length", err)
 		}
-		_c.ADDR = make([]byte, addrLen+1)
+		_c.ADDR = make([]byte, int(addrLen)+1)
 		_c.ADDR[0] = addrLen
 		_, err = io.ReadFull(reader, _c.ADDR[1:])
 		if err != nil {
-			return
+			return nil, truncatedAddressError(_c.TYPE, "addr", err)
 		}
+	case AtypNone:
+		return &_c, nil
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnknownAddressType, _c.TYPE)
 	}
 
-	if _c.TYPE == AtypNone {
-		return
-	}
 	err = binary.Read(reader, binary.BigEndian, &_c.PORT)
 	if err != nil {
-		return
+		return nil, truncatedAddressError(_c.TYPE, "port", err)
 	}
 	return &_c, nil
 }
 
+func truncatedAddressError(typ byte, field string, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &addressReadError{typ: typ, field: field, err: err}
+}
+
+// addressReadError is ErrTruncatedAddress and wraps the error of the read, so
+// that errors.Is holds for both.
+type addressReadError struct {
+	typ   byte
+	field string
+	err   error
+}
+
+func (e *addressReadError) Error() string {
+	return fmt.Sprintf("%v: type %v: read %v: %v", ErrTruncatedAddress, e.typ, e.field, e.err)
+}
+
+func (e *addressReadError) Is(target error) bool {
+	return target == ErrTruncatedAddress
+}
+
+func (e *addressReadError) Unwrap() error {
+	return e.err
+}
+
 func (c Address) WriteTo(writer BufferedWriter) (err error) {
 	err = writer.WriteByte(c.TYPE)
 	if err != nil {
@@ -583,6 +634,9 @@ func (c Address) UDPAddr() *net.UDPAddr {
 }
 
 func (c Address) BytesLen() int {
+	if c.TYPE == AtypNone {
+		return 1
+	}
 	return 1 + len(c.ADDR) + 2
 }
 
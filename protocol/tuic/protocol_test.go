@@ -0,0 +1,58 @@
+package tuic
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+)
+
+func TestReadAddressTruncated(t *testing.T) {
+	tt := []struct {
+		name string
+		b    []byte
+	}{
+		{"ipv4 addr", []byte{AtypIPv4, 127, 0}},
+		{"ipv4 port", []byte{AtypIPv4, 127, 0, 0, 1, 0}},
+		{"ipv6 addr", []byte{AtypIPv6, 0, 0, 0, 0, 0}},
+		{"ipv6 port", append([]byte{AtypIPv6}, make([]byte, 16)...)},
+		{"domain length", []byte{AtypDomainName}},
+		{"domain addr", []byte{AtypDomainName, 11, 'e', 'x', 'a'}},
+		{"domain port", []byte{AtypDomainName, 1, 'a', 0}},
+	}
+	for _, test := range tt {
+		_, err := ReadAddress(bytes.NewReader(test.b))
+		if !errors.Is(err, ErrTruncatedAddress) || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatal(test.name, err)
+		}
+	}
+}
+
+func TestReadAddressUnknownType(t *testing.T) {
+	_, err := ReadAddress(bytes.NewReader([]byte{0x10, 0, 0}))
+	if !errors.Is(err, ErrUnknownAddressType) {
+		t.Fatal(err)
+	}
+}
+
+func TestReadPacketTruncatedAddress(t *testing.T) {
+	buf := new(bytes.Buffer)
+	address := NewAddressAddrPort(netip.MustParseAddrPort("[2001:db8::1]:53"))
+	if err := NewPacket(1, 2, 1, 0, 3, address, []byte("abc"), Ver5).WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	full := buf.Bytes()
+	// Cut inside the address: head(2) + assoc/pkt/frag/size(8) + type(1) + 4 bytes.
+	_, err := ReadPacket(bytes.NewReader(full[:15]))
+	if !errors.Is(err, ErrTruncatedAddress) {
+		t.Fatal(err)
+	}
+	packet, err := ReadPacket(bytes.NewReader(full))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.ADDR.String() != "[2001:db8::1]:53" {
+		t.Fatal(packet.ADDR.String())
+	}
+}
@@ -0,0 +1,31 @@
+package tuic
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mzz2017/quic-go"
+	"github.com/mzz2017/quic-go/logging"
+	"github.com/mzz2017/quic-go/qlog"
+)
+
+// qlogTracer returns a quic.Config.Tracer that writes the qlog trace of each
+// connection to the writer newWriter returns for it.
+func qlogTracer(newWriter func(connectionId string) (io.WriteCloser, error)) func(context.Context, logging.Perspective, quic.ConnectionID) logging.ConnectionTracer {
+	return func(_ context.Context, perspective logging.Perspective, odcid quic.ConnectionID) logging.ConnectionTracer {
+		w, err := newWriter(odcid.String())
+		if err != nil {
+			return nil
+		}
+		return qlog.NewConnectionTracer(w, perspective, odcid)
+	}
+}
+
+// qlogDirWriter creates the trace file of each connection in dir.
+func qlogDirWriter(dir string) func(connectionId string) (io.WriteCloser, error) {
+	return func(connectionId string) (io.WriteCloser, error) {
+		return os.Create(filepath.Join(dir, connectionId+"_client.qlog"))
+	}
+}
@@ -0,0 +1,59 @@
+package tuic
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	rateInterval = time.Second
+	rateAlpha    = 0.3
+)
+
+// rateEstimator estimates a rate in bytes per second. It counts bytes in
+// fixed intervals and smooths the per-interval rates with an EWMA.
+type rateEstimator struct {
+	mu    sync.Mutex
+	start time.Time
+	bytes uint64
+	rate  float64
+}
+
+// advance folds finished intervals into the rate.
+func (r *rateEstimator) advance(now time.Time) {
+	if r.start.IsZero() {
+		r.start = now
+		return
+	}
+	elapsed := int(now.Sub(r.start) / rateInterval)
+	if elapsed <= 0 {
+		return
+	}
+	sample := float64(r.bytes) / rateInterval.Seconds()
+	r.rate = rateAlpha*sample + (1-rateAlpha)*r.rate
+	// Idle intervals decay the rate.
+	for i := 1; i < elapsed && r.rate > 0; i++ {
+		if i >= 64 {
+			r.rate = 0
+			break
+		}
+		r.rate *= 1 - rateAlpha
+	}
+	r.bytes = 0
+	r.start = r.start.Add(time.Duration(elapsed) * rateInterval)
+}
+
+func (r *rateEstimator) Add(n int, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.advance(now)
+	r.bytes += uint64(n)
+}
+
+// Rate returns the estimated bytes per second.
+func (r *rateEstimator) Rate(now time.Time) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.advance(now)
+	return r.rate
+}
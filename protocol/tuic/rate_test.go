@@ -0,0 +1,25 @@
+package tuic
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRateEstimatorConverges(t *testing.T) {
+	var r rateEstimator
+	now := time.Unix(0, 0)
+	// 100 KB/s in packets of 1000 bytes.
+	for i := 0; i < 3000; i++ {
+		r.Add(1000, now)
+		now = now.Add(10 * time.Millisecond)
+	}
+	if rate := r.Rate(now); math.Abs(rate-100_000) > 1000 {
+		t.Fatal("rate does not converge:", rate)
+	}
+	// Idle for a while.
+	now = now.Add(time.Minute)
+	if rate := r.Rate(now); rate > 1 {
+		t.Fatal("rate does not decay:", rate)
+	}
+}
@@ -0,0 +1,59 @@
+package tuic
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+// DefaultRetryDelay is the delay before the retry of NewRetryPacketConn.
+const DefaultRetryDelay = 5 * time.Millisecond
+
+// IsTransientError reports whether a failed send is worth retrying, e.g. if
+// the stream limit of the peer is reached for the moment. Too-large, closed
+// and timeout errors are not transient.
+func IsTransientError(err error) bool {
+	if err == nil || errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	if errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.EAGAIN) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && !netErr.Timeout() && netErr.Temporary()
+}
+
+type retryPacketConn struct {
+	netproxy.PacketConn
+	delay time.Duration
+}
+
+// NewRetryPacketConn returns a PacketConn whose WriteTo retries once after delay
+// if the send fails with a transient error. Other errors are returned at once.
+func NewRetryPacketConn(pc netproxy.PacketConn, delay time.Duration) netproxy.PacketConn {
+	return &retryPacketConn{
+		PacketConn: pc,
+		delay:      delay,
+	}
+}
+
+func (c *retryPacketConn) WriteTo(p []byte, addr string) (n int, err error) {
+	n, err = c.PacketConn.WriteTo(p, addr)
+	if !IsTransientError(err) {
+		return n, err
+	}
+	time.Sleep(c.delay)
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *retryPacketConn) Write(b []byte) (n int, err error) {
+	n, err = c.PacketConn.Write(b)
+	if !IsTransientError(err) {
+		return n, err
+	}
+	time.Sleep(c.delay)
+	return c.PacketConn.Write(b)
+}
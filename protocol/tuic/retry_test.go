@@ -0,0 +1,68 @@
+package tuic
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/mzz2017/quic-go"
+)
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "flow control blocked" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestRetryPacketConn(t *testing.T) {
+	quicConn := &fakeQuicConn{sendErrs: []error{temporaryError{}}}
+	pc := NewRetryPacketConn(newTestPacketConn(quicConn), 0)
+	if _, err := pc.WriteTo([]byte("hello"), "1.1.1.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	if quicConn.sendCalls != 2 || len(quicConn.messages) != 1 {
+		t.Fatal("unexpected sends", quicConn.sendCalls, len(quicConn.messages))
+	}
+
+	// Only one retry.
+	quicConn = &fakeQuicConn{sendErrs: []error{temporaryError{}, temporaryError{}}}
+	pc = NewRetryPacketConn(newTestPacketConn(quicConn), 0)
+	if _, err := pc.WriteTo([]byte("hello"), "1.1.1.1:53"); !errors.Is(err, temporaryError{}) {
+		t.Fatal(err)
+	}
+	if quicConn.sendCalls != 2 {
+		t.Fatal("unexpected sends", quicConn.sendCalls)
+	}
+
+	errPermanent := errors.New("permanent")
+	quicConn = &fakeQuicConn{sendErrs: []error{errPermanent}}
+	pc = NewRetryPacketConn(newTestPacketConn(quicConn), 0)
+	if _, err := pc.WriteTo([]byte("hello"), "1.1.1.1:53"); err != errPermanent {
+		t.Fatal(err)
+	}
+	if quicConn.sendCalls != 1 {
+		t.Fatal("non-transient error is retried")
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	tt := []struct {
+		err       error
+		transient bool
+	}{
+		{nil, false},
+		{temporaryError{}, true},
+		{fmt.Errorf("send: %w", syscall.ENOBUFS), true},
+		{quic.ErrMessageTooLarge(1200), false},
+		{net.ErrClosed, false},
+		{&CloseError{Cause: ErrPeerClose}, false},
+		{errors.New("other"), false},
+	}
+	for _, test := range tt {
+		if IsTransientError(test.err) != test.transient {
+			t.Fatal(test.err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package tuic
+
+import (
+	"context"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	"github.com/daeuniverse/softwind/protocol/tuic/common"
+	"github.com/mzz2017/quic-go"
+)
+
+// rotateDialTimeout bounds the dial of the connection that replaces an old one.
+var rotateDialTimeout = 10 * time.Second
+
+// lifetimeAfterFunc schedules the rotation of a connection after
+// MaxConnLifetime. Tests replace it to rotate on demand.
+var lifetimeAfterFunc = time.AfterFunc
+
+// rotate replaces old, the connection of the client, with a new one once old
+// reaches MaxConnLifetime. UDP sessions on old migrate to the new connection,
+// and new streams and sessions go to it. TCP streams cannot move, so old is
+// retired and closed once its last stream is closed. If the dial fails, old is
+// kept and rotate is retried after another MaxConnLifetime.
+func (t *clientImpl) rotate(old quic.Connection, dialer netproxy.Dialer, dialFn common.DialFunc) {
+	t.connMutex.Lock()
+	closed := t.closed || t.quicConn != old
+	t.connMutex.Unlock()
+	if closed {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rotateDialTimeout)
+	quicConn, socket, err := t.dialQuicConn(ctx, dialer, dialFn)
+	cancel()
+
+	t.connMutex.Lock()
+	if t.closed || t.quicConn != old {
+		t.connMutex.Unlock()
+		if err == nil {
+			_ = quicConn.CloseWithError(0, "")
+		}
+		return
+	}
+	if err != nil {
+		t.rotateTimer = lifetimeAfterFunc(t.MaxConnLifetime, func() {
+			t.rotate(old, dialer, dialFn)
+		})
+		t.connMutex.Unlock()
+		return
+	}
+	t.muStreams.Lock()
+	if t.retired == nil {
+		t.retired = make(map[quic.Connection]struct{})
+	}
+	t.retired[old] = struct{}{}
+	t.muStreams.Unlock()
+	t.setQuicConn(quicConn, socket, dialer, dialFn)
+	t.connMutex.Unlock()
+
+	t.udpSessions.Range(func(key, value any) bool {
+		value.(*quicStreamPacketConn).migrate(old, quicConn, socket)
+		return true
+	})
+	t.closeIfIdle(old)
+}
+
+// acquireStream returns the connection to open a TCP stream on and counts the
+// stream on it. releaseStream must be called once the stream is closed.
+func (t *clientImpl) acquireStream(ctx context.Context, dialer netproxy.Dialer, dialFn common.DialFunc) (quic.Connection, error) {
+	for {
+		quicConn, err := t.getQuicConn(ctx, dialer, dialFn)
+		if err != nil {
+			return nil, err
+		}
+		t.muStreams.Lock()
+		if _, retired := t.retired[quicConn]; retired {
+			// Rotated in the meantime.
+			t.muStreams.Unlock()
+			continue
+		}
+		if t.streams == nil {
+			t.streams = make(map[quic.Connection]int)
+		}
+		t.streams[quicConn]++
+		t.muStreams.Unlock()
+		return quicConn, nil
+	}
+}
+
+func (t *clientImpl) releaseStream(quicConn quic.Connection) {
+	t.muStreams.Lock()
+	if t.streams[quicConn]--; t.streams[quicConn] <= 0 {
+		delete(t.streams, quicConn)
+	}
+	t.muStreams.Unlock()
+	t.closeIfIdle(quicConn)
+}
+
+// closeIfIdle closes quicConn if it is retired and no stream is open on it.
+func (t *clientImpl) closeIfIdle(quicConn quic.Connection) {
+	t.muStreams.Lock()
+	_, retired := t.retired[quicConn]
+	idle := retired && t.streams[quicConn] == 0
+	if idle {
+		delete(t.retired, quicConn)
+	}
+	t.muStreams.Unlock()
+	if idle {
+		_ = quicConn.CloseWithError(0, "rotated")
+	}
+}
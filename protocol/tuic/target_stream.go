@@ -0,0 +1,119 @@
+package tuic
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/mzz2017/quic-go"
+)
+
+// targetStreams keeps a long-lived uni-stream per target in QUIC relay mode so
+// that packets to one target stay in order without blocking other targets. The
+// least recently used stream is closed once there are more than size targets.
+type targetStreams struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type targetStream struct {
+	target string
+
+	mu     sync.Mutex
+	stream quic.SendStream
+	closed bool
+}
+
+func newTargetStreams(size int) *targetStreams {
+	return &targetStreams{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element, size),
+	}
+}
+
+// Write writes b to the stream of target, opening one if there is none.
+func (s *targetStreams) Write(quicConn quic.Connection, target string, b []byte) error {
+	ts, evicted, err := s.get(quicConn, target)
+	if evicted != nil {
+		evicted.close()
+	}
+	if err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.closed {
+		// Evicted concurrently. Fall back to a stream of its own.
+		stream, err := quicConn.OpenUniStream()
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		_, err = stream.Write(b)
+		return err
+	}
+	if _, err = ts.stream.Write(b); err != nil {
+		s.remove(ts)
+		ts.stream.CancelWrite(0)
+		ts.closed = true
+		return err
+	}
+	return nil
+}
+
+func (s *targetStreams) get(quicConn quic.Connection, target string) (ts *targetStream, evicted *targetStream, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[target]; ok {
+		s.ll.MoveToFront(e)
+		return e.Value.(*targetStream), nil, nil
+	}
+	stream, err := quicConn.OpenUniStream()
+	if err != nil {
+		return nil, nil, err
+	}
+	ts = &targetStream{target: target, stream: stream}
+	s.items[target] = s.ll.PushFront(ts)
+	if s.ll.Len() > s.size {
+		oldest := s.ll.Back()
+		s.ll.Remove(oldest)
+		evicted = oldest.Value.(*targetStream)
+		delete(s.items, evicted.target)
+	}
+	return ts, evicted, nil
+}
+
+func (s *targetStreams) remove(ts *targetStream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[ts.target]; ok && e.Value == ts {
+		s.ll.Remove(e)
+		delete(s.items, ts.target)
+	}
+}
+
+// Close closes all streams.
+func (s *targetStreams) Close() {
+	s.mu.Lock()
+	var all []*targetStream
+	for e := s.ll.Front(); e != nil; e = e.Next() {
+		all = append(all, e.Value.(*targetStream))
+	}
+	s.ll.Init()
+	s.items = make(map[string]*list.Element)
+	s.mu.Unlock()
+	for _, ts := range all {
+		ts.close()
+	}
+}
+
+func (ts *targetStream) close() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if !ts.closed {
+		ts.closed = true
+		_ = ts.stream.Close()
+	}
+}
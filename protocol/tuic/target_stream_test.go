@@ -0,0 +1,76 @@
+package tuic
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/daeuniverse/softwind/protocol/tuic/common"
+)
+
+func readStreamPackets(t *testing.T, s *fakeSendStream) []*Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reader := bufio.NewReader(bytes.NewReader(s.buf.Bytes()))
+	var packets []*Packet
+	for {
+		packet, err := ReadPacket(reader)
+		if errors.Is(err, io.EOF) {
+			return packets
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+	}
+}
+
+func TestTargetStreams(t *testing.T) {
+	quicConn := &fakeQuicConn{}
+	cli := newTestClient(quicConn)
+	cli.UdpRelayMode = common.QUIC
+	cli.MaxTargetStreams = 2
+	pc := listenTestPacket(t, cli, "1.1.1.1:53")
+	targets := []string{"1.1.1.1:53", "8.8.8.8:53", "1.1.1.1:53", "9.9.9.9:53", "8.8.8.8:53"}
+	for _, target := range targets {
+		if _, err := pc.WriteTo([]byte(target), target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 9.9.9.9 evicts 8.8.8.8, which then evicts 1.1.1.1.
+	expected := [][]string{
+		{"1.1.1.1:53", "1.1.1.1:53"},
+		{"8.8.8.8:53"},
+		{"9.9.9.9:53"},
+		{"8.8.8.8:53"},
+	}
+	expectedClosed := []bool{true, true, false, false}
+	if len(quicConn.uniStreams) != len(expected) {
+		t.Fatal("unexpected stream count", len(quicConn.uniStreams))
+	}
+	for i, stream := range quicConn.uniStreams {
+		packets := readStreamPackets(t, stream)
+		if len(packets) != len(expected[i]) {
+			t.Fatal("stream", i, "has", len(packets), "packets")
+		}
+		for j, packet := range packets {
+			if packet.ADDR.String() != expected[i][j] || string(packet.DATA) != expected[i][j] {
+				t.Fatal("stream", i, "unexpected packet", packet.ADDR.String())
+			}
+		}
+		if stream.closed != expectedClosed[i] {
+			t.Fatal("stream", i, "closed:", stream.closed)
+		}
+	}
+
+	if err := pc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i, stream := range quicConn.uniStreams[:4] {
+		if !stream.closed {
+			t.Fatal("stream", i, "is not closed with the packet conn")
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package tuic
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate tokens per second with bursts of up to burst tokens.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+			b.tokens += elapsed * b.rate
+			if b.tokens > b.burst {
+				b.tokens = b.burst
+			}
+		}
+	}
+	b.last = now
+}
+
+// Allow takes n tokens if there are enough.
+func (b *tokenBucket) Allow(n float64, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Wait takes n tokens, waiting until there are enough or ctx is done.
+func (b *tokenBucket) Wait(ctx context.Context, n float64) error {
+	for {
+		b.mu.Lock()
+		b.refill(time.Now())
+		if b.tokens >= n {
+			b.tokens -= n
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// inboundLimiter limits incoming packets by count and by bytes. A nil
+// inboundLimiter allows everything.
+type inboundLimiter struct {
+	packets *tokenBucket
+	bytes   *tokenBucket
+}
+
+// newInboundLimiter returns nil if both rates are 0. Bursts of one second are
+// allowed.
+func newInboundLimiter(packetsPerSec int, bytesPerSec int) *inboundLimiter {
+	if packetsPerSec <= 0 && bytesPerSec <= 0 {
+		return nil
+	}
+	l := &inboundLimiter{}
+	if packetsPerSec > 0 {
+		l.packets = newTokenBucket(float64(packetsPerSec), float64(packetsPerSec))
+	}
+	if bytesPerSec > 0 {
+		l.bytes = newTokenBucket(float64(bytesPerSec), float64(bytesPerSec))
+	}
+	return l
+}
+
+func (l *inboundLimiter) Allow(n int, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	if l.packets != nil && !l.packets.Allow(1, now) {
+		return false
+	}
+	// A packet over the byte limit has taken a packet token anyway.
+	return l.bytes == nil || l.bytes.Allow(float64(n), now)
+}
@@ -0,0 +1,70 @@
+package tuic
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 5)
+	for i := 0; i < 5; i++ {
+		if !b.Allow(1, now) {
+			t.Fatal("burst is not allowed", i)
+		}
+	}
+	if b.Allow(1, now) {
+		t.Fatal("exceeds the burst")
+	}
+	if !b.Allow(1, now.Add(100*time.Millisecond)) || b.Allow(1, now.Add(100*time.Millisecond)) {
+		t.Fatal("unexpected refill")
+	}
+	if b.Allow(6, now.Add(time.Hour)) {
+		t.Fatal("refill exceeds the burst")
+	}
+}
+
+func TestInboundLimit(t *testing.T) {
+	const flood = 200
+	quicConn := &fakeQuicConn{incoming: make(chan []byte, flood)}
+	cli := newTestClient(quicConn)
+	cli.InboundPacketsPerSec = 20
+	pc := listenTestPacket(t, cli, "1.1.1.1:53")
+	defer pc.Close()
+	address, err := pc.address("1.1.1.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < flood; i++ {
+		buf := new(bytes.Buffer)
+		if err := NewPacket(pc.connId, uint16(i), 1, 0, 4, address, []byte("ping"), Ver5).WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		quicConn.incoming <- buf.Bytes()
+	}
+	start := time.Now()
+	go func() {
+		_ = cli.handleMessage(quicConn)
+	}()
+	queued := func() int {
+		pc.incomingPackets.mu.Lock()
+		defer pc.incomingPackets.mu.Unlock()
+		return pc.incomingPackets.list.Len()
+	}
+	deadline := time.Now().Add(time.Second)
+	for int(cli.InboundDropped())+queued() != flood {
+		if time.Now().After(deadline) {
+			t.Fatal("packets are lost", cli.InboundDropped(), queued())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The burst plus what is refilled during the flood.
+	limit := 20 + int(time.Since(start).Seconds()*20) + 1
+	if n := queued(); n < 20 || n > limit {
+		t.Fatal("unexpected delivered packets", n, "limit", limit)
+	}
+	if cli.InboundDropped() == 0 {
+		t.Fatal("drops are not counted")
+	}
+}
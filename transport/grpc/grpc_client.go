@@ -3,11 +3,13 @@ package grpc
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/daeuniverse/softwind/netproxy"
@@ -20,12 +22,49 @@ import (
 	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
 // https://github.com/v2fly/v2ray-core/blob/v5.0.6/transport/internet/grpc/dial.go
 type clientConnMeta struct {
 	cc *grpc.ClientConn
+	// owner is the Dialer whose next dialer of generation gen cc dials
+	// through.
+	owner *Dialer
+	gen   uint64
+
+	// mu guards tuns and retired. A retired cc is out of globalCCMap, and it
+	// is closed once its tuns are.
+	mu      sync.Mutex
+	tuns    int
+	retired bool
+}
+
+func (m *clientConnMeta) acquire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tuns++
+}
+
+func (m *clientConnMeta) release() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tuns--
+	if m.retired && m.tuns == 0 {
+		_ = m.cc.Close()
+	}
+}
+
+// retire closes cc once its tuns are closed, so that it no longer reconnects
+// through a replaced next dialer. m must have been removed from globalCCMap.
+func (m *clientConnMeta) retire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retired = true
+	if m.tuns == 0 {
+		_ = m.cc.Close()
+	}
 }
 
 var (
@@ -41,6 +80,36 @@ func CleanGlobalClientConnectionCache() {
 
 type ccCanceller func()
 
+// ErrServiceNotFound is returned if the server does not serve the configured
+// service name.
+var ErrServiceNotFound = errors.New("grpc service not found")
+
+// StatusError is returned by Read if the server ends the tun with a non-OK
+// status that no other error describes.
+type StatusError struct {
+	Code    codes.Code
+	Message string
+	// Trailer is the trailer metadata the server ends the tun with.
+	Trailer metadata.MD
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("grpc tun ended: %v: %v", e.Code, e.Message)
+}
+
+// GRPCStatus makes status.Code and status.Convert work with the error.
+func (e *StatusError) GRPCStatus() *status.Status {
+	return status.New(e.Code, e.Message)
+}
+
+// TrailerConn is implemented by conns that expose the trailer metadata of the
+// stream under them.
+type TrailerConn interface {
+	// Trailer returns the trailer metadata, which is nil until the stream
+	// ends.
+	Trailer() metadata.MD
+}
+
 type ClientConn struct {
 	tun       proto.GunService_TunClient
 	closer    context.CancelFunc
@@ -50,6 +119,11 @@ type ClientConn struct {
 	muSend    sync.Mutex // muWriting protects send
 	buf       []byte
 	offset    int
+	// path is the method path of the tun, used in error messages.
+	path string
+
+	muTrailer sync.Mutex
+	trailer   metadata.MD
 
 	deadlineMu    sync.Mutex
 	readDeadline  *time.Timer
@@ -69,6 +143,16 @@ func NewClientConn(tun proto.GunService_TunClient, closer context.CancelFunc) *C
 	}
 }
 
+// Trailer returns the trailer metadata of the tun once Read has returned the
+// end of it. It is nil before.
+func (c *ClientConn) Trailer() metadata.MD {
+	c.muTrailer.Lock()
+	defer c.muTrailer.Unlock()
+	return c.trailer
+}
+
+var _ TrailerConn = (*ClientConn)(nil)
+
 type RecvResp struct {
 	hunk *proto.Hunk
 	err  error
@@ -102,6 +186,12 @@ func (c *ClientConn) Read(p []byte) (n int, err error) {
 		c.muRecv.Lock()
 		defer c.muRecv.Unlock()
 		recv, e := c.tun.Recv()
+		if e != nil {
+			// The trailer is only available once the stream ends.
+			c.muTrailer.Lock()
+			c.trailer = c.tun.Trailer()
+			c.muTrailer.Unlock()
+		}
 		readDone <- RecvResp{
 			hunk: recv,
 			err:  e,
@@ -115,8 +205,16 @@ func (c *ClientConn) Read(p []byte) (n int, err error) {
 	case recvResp := <-readDone:
 		err = recvResp.err
 		if err != nil {
-			if code := status.Code(err); code == codes.Unavailable || status.Code(err) == codes.OutOfRange {
+			switch status.Code(err) {
+			case codes.Unavailable, codes.OutOfRange:
 				err = io.EOF
+			case codes.Unimplemented:
+				// The server rejects the path, e.g. with HTTP 404.
+				err = fmt.Errorf("%w: %v: %v", ErrServiceNotFound, c.path, status.Convert(err).Message())
+			default:
+				if st, ok := status.FromError(err); ok && st.Code() != codes.OK {
+					err = &StatusError{Code: st.Code(), Message: st.Message(), Trailer: c.Trailer()}
+				}
 			}
 			return 0, err
 		}
@@ -300,6 +398,43 @@ type Dialer struct {
 	ServiceName   string
 	ServerName    string
 	AllowInsecure bool
+
+	// muNextDialer protects NextDialer and nextDialerGen once the Dialer is
+	// in use. nextDialerGen counts the calls to SetDialer.
+	muNextDialer  sync.RWMutex
+	nextDialerGen uint64
+}
+
+// SetDialer replaces the next dialer at runtime. Dials in progress keep using
+// the dialer they started with and new dials pick up the replacement.
+// Established connections are not affected, but the gRPC client connections
+// cached for them are no longer shared with new dials: each is closed once its
+// connections are, instead of reconnecting through the replaced dialer.
+func (d *Dialer) SetDialer(dialer netproxy.Dialer) {
+	contextDialer, ok := dialer.(netproxy.ContextDialer)
+	if !ok {
+		contextDialer = &netproxy.ContextDialerConverter{Dialer: dialer}
+	}
+	d.muNextDialer.Lock()
+	d.NextDialer = contextDialer
+	d.nextDialerGen++
+	gen := d.nextDialerGen
+	d.muNextDialer.Unlock()
+
+	globalCCAccess.Lock()
+	defer globalCCAccess.Unlock()
+	for address, meta := range globalCCMap {
+		if meta.owner == d && meta.gen < gen {
+			delete(globalCCMap, address)
+			meta.retire()
+		}
+	}
+}
+
+func (d *Dialer) nextDialer() (netproxy.ContextDialer, uint64) {
+	d.muNextDialer.RLock()
+	defer d.muNextDialer.RUnlock()
+	return d.NextDialer, d.nextDialerGen
 }
 
 func (d *Dialer) Dial(network, address string) (netproxy.Conn, error) {
@@ -317,12 +452,18 @@ func (d *Dialer) Dial(network, address string) (netproxy.Conn, error) {
 	}
 }
 
+// Capabilities reports that the Dialer dials TCP with a context. UDP is not
+// supported.
+func (d *Dialer) Capabilities() netproxy.Capabilities {
+	return netproxy.CapabilityTcp | netproxy.CapabilityContext
+}
+
 func (d *Dialer) DialContext(ctx context.Context, network string, address string) (netproxy.Conn, error) {
 	magicNetwork, err := netproxy.ParseMagicNetwork(network)
 	if err != nil {
 		return nil, err
 	}
-	meta, cancel, err := getGrpcClientConn(ctx, d.NextDialer, d.ServerName, address, d.AllowInsecure, magicNetwork.Mark)
+	meta, cancel, err := getGrpcClientConn(ctx, d, d.ServerName, address, d.AllowInsecure, magicNetwork.Mark)
 	if err != nil {
 		cancel()
 		return nil, err
@@ -339,18 +480,124 @@ func (d *Dialer) DialContext(ctx context.Context, network string, address string
 	tun, err := clientX.TunCustomName(ctxStream, serviceName)
 	if err != nil {
 		streamCloser()
+		meta.release()
 		return nil, err
 	}
-	return NewClientConn(tun, streamCloser), nil
+	var closeOnce sync.Once
+	conn := NewClientConn(tun, func() {
+		closeOnce.Do(func() {
+			streamCloser()
+			meta.release()
+		})
+	})
+	conn.path = "/" + serviceName + "/Tun"
+	return conn, nil
 }
 
-func getGrpcClientConn(ctx context.Context, tcpDialer netproxy.ContextDialer, serverName string, address string, allowInsecure bool, somark uint32) (*clientConnMeta, ccCanceller, error) {
-	// allowInsecure?
+// Upgrade runs the tunnel over conn, an established plaintext conn to the
+// server such as one yielded by a prior hop of a chain, instead of dialing with
+// NextDialer. The TLS handshake on conn uses ServerName and AllowInsecure, and
+// the ALPN of gRPC. ctx bounds the TLS and HTTP/2 handshakes, which are
+// complete once Upgrade returns, and the TLS handshake is reported to the
+// netproxy.DialTrace carried by ctx. The gRPC client conn over conn is not shared
+// with other dials and is closed with the returned conn, as conn cannot be
+// re-dialed.
+func (d *Dialer) Upgrade(ctx context.Context, conn netproxy.Conn, address string) (netproxy.Conn, error) {
+	certOption, err := tlsCredentials(d.ServerName, d.AllowInsecure, netproxy.ContextDialTrace(ctx))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	var dialed int32
+	cc, err := grpc.DialContext(ctx, address,
+		certOption,
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			if !atomic.CompareAndSwapInt32(&dialed, 0, 1) {
+				return nil, net.ErrClosed
+			}
+			return &netproxy.FakeNetConn{Conn: conn}, nil
+		}),
+		grpc.WithBlock(),
+		grpc.FailOnNonTempDialError(true),
+		grpc.WithKeepaliveParams(clientKeepalive),
+	)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	serviceName := d.ServiceName
+	if serviceName == "" {
+		serviceName = "GunService"
+	}
+	ctxStream, streamCloser := context.WithCancel(context.Background())
+	tun, err := proto.NewGunServiceClient(cc).(proto.GunServiceClientX).TunCustomName(ctxStream, serviceName)
+	if err != nil {
+		streamCloser()
+		_ = cc.Close()
+		return nil, err
+	}
+	c := NewClientConn(tun, func() {
+		streamCloser()
+		_ = cc.Close()
+	})
+	c.path = "/" + serviceName + "/Tun"
+	return c, nil
+}
+
+var clientKeepalive = keepalive.ClientParameters{
+	Time:                30 * time.Second,
+	Timeout:             10 * time.Second,
+	PermitWithoutStream: true,
+}
+
+// tlsCredentials returns the TLS credentials of a gRPC client conn. The first
+// handshake of the conn is reported to trace if it is not nil.
+func tlsCredentials(serverName string, allowInsecure bool, trace *netproxy.DialTrace) (grpc.DialOption, error) {
 	roots, err := cert.GetSystemCertPool()
 	if err != nil {
-		return nil, func() {}, fmt.Errorf("failed to get system certificate pool")
+		return nil, fmt.Errorf("failed to get system certificate pool")
+	}
+	creds := credentials.NewTLS(&tls.Config{ServerName: serverName, RootCAs: roots, InsecureSkipVerify: allowInsecure})
+	if trace != nil {
+		creds = &tracingCredentials{TransportCredentials: creds, trace: trace, traced: new(int32)}
+	}
+	return grpc.WithTransportCredentials(creds), nil
+}
+
+// tracingCredentials reports the first handshake done with it to trace.
+type tracingCredentials struct {
+	credentials.TransportCredentials
+	trace *netproxy.DialTrace
+	// traced is shared by the clones.
+	traced *int32
+}
+
+func (c *tracingCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, authInfo, err := c.TransportCredentials.ClientHandshake(ctx, authority, rawConn)
+	if atomic.CompareAndSwapInt32(c.traced, 0, 1) {
+		netproxy.TraceHandshakeDone(c.trace, err)
+	}
+	return conn, authInfo, err
+}
+
+func (c *tracingCredentials) Clone() credentials.TransportCredentials {
+	return &tracingCredentials{
+		TransportCredentials: c.TransportCredentials.Clone(),
+		trace:                c.trace,
+		traced:               c.traced,
+	}
+}
+
+// getGrpcClientConn returns the client conn to address dialed through the next
+// dialer of owner, which may be shared with other dials. The returned conn is
+// acquired and must be released once the tun over it is closed.
+func getGrpcClientConn(ctx context.Context, owner *Dialer, serverName string, address string, allowInsecure bool, somark uint32) (*clientConnMeta, ccCanceller, error) {
+	// allowInsecure?
+	trace := netproxy.ContextDialTrace(ctx)
+	certOption, err := tlsCredentials(serverName, allowInsecure, trace)
+	if err != nil {
+		return nil, func() {}, err
 	}
-	certOption := grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{ServerName: serverName, RootCAs: roots, InsecureSkipVerify: allowInsecure}))
 
 	globalCCAccess.Lock()
 	if globalCCMap == nil {
@@ -365,16 +612,28 @@ func getGrpcClientConn(ctx context.Context, tcpDialer netproxy.ContextDialer, se
 		delete(globalCCMap, address)
 	}
 
+	tcpDialer, gen := owner.nextDialer()
 	// TODO Should support chain proxy to the same destination
 	globalCCAccess.Lock()
 	if meta, found := globalCCMap[address]; found && meta.cc.GetState() != connectivity.Shutdown {
-		globalCCAccess.Unlock()
-		return meta, canceller, nil
+		if meta.owner != owner || meta.gen >= gen {
+			meta.acquire()
+			globalCCAccess.Unlock()
+			return meta, canceller, nil
+		}
+		// The next dialer of owner has been replaced since cc was dialed.
+		delete(globalCCMap, address)
+		meta.retire()
 	}
 	globalCCAccess.Unlock()
 	meta := &clientConnMeta{
-		cc: nil,
+		cc:    nil,
+		owner: owner,
+		gen:   gen,
+		tuns:  1,
 	}
+	// Only the first connect of the new client conn is part of the dial.
+	var connectTraced int32
 	meta.cc, err = grpc.DialContext(ctx, address,
 		certOption,
 		grpc.WithContextDialer(func(ctxGrpc context.Context, s string) (net.Conn, error) {
@@ -383,6 +642,9 @@ func getGrpcClientConn(ctx context.Context, tcpDialer netproxy.ContextDialer, se
 				Mark:    somark,
 			}.Encode()
 			c, err := tcpDialer.DialContext(ctxGrpc, tcpNetwork, s)
+			if atomic.CompareAndSwapInt32(&connectTraced, 0, 1) {
+				netproxy.TraceConnectDone(trace, err)
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -399,17 +661,18 @@ func getGrpcClientConn(ctx context.Context, tcpDialer netproxy.ContextDialer, se
 				MaxDelay:   19 * time.Second,
 			},
 			MinConnectTimeout: 5 * time.Second,
-		}), grpc.WithKeepaliveParams(keepalive.ClientParameters{
-			Time:                30 * time.Second,
-			Timeout:             10 * time.Second,
-			PermitWithoutStream: true,
-		}),
+		}), grpc.WithKeepaliveParams(clientKeepalive),
 	)
 	if err != nil {
 		return nil, canceller, err
 	}
 	globalCCAccess.Lock()
-	globalCCMap[address] = meta
+	if _, currentGen := owner.nextDialer(); currentGen == gen {
+		globalCCMap[address] = meta
+	} else {
+		// SetDialer is called during the dial, so cc is not shared.
+		meta.retire()
+	}
 	globalCCAccess.Unlock()
 	return meta, canceller, err
 }
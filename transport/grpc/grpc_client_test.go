@@ -0,0 +1,509 @@
+package grpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+	proto "github.com/daeuniverse/softwind/pkg/gun_proto"
+	"github.com/daeuniverse/softwind/protocol/direct"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type countDialer struct {
+	count int32
+
+	mu    sync.Mutex
+	addrs map[string]int
+}
+
+func (d *countDialer) dialed(addr string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.addrs[addr]
+}
+
+func (d *countDialer) Dial(network string, addr string) (c netproxy.Conn, err error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *countDialer) DialContext(ctx context.Context, network, addr string) (c netproxy.Conn, err error) {
+	atomic.AddInt32(&d.count, 1)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.addrs == nil {
+		d.addrs = make(map[string]int)
+	}
+	d.addrs[addr]++
+	return nil, errors.New("refused")
+}
+
+// closeGlobalClientConns stops cached client conns from reconnecting.
+func closeGlobalClientConns() {
+	globalCCAccess.Lock()
+	defer globalCCAccess.Unlock()
+	for addr, meta := range globalCCMap {
+		_ = meta.cc.Close()
+		delete(globalCCMap, addr)
+	}
+}
+
+func TestSetDialer(t *testing.T) {
+	defer closeGlobalClientConns()
+	first := &countDialer{}
+	second := &countDialer{}
+	d := &Dialer{NextDialer: first, ServerName: "example.com"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _ = d.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", 10000+i))
+		}(i)
+		if i == 4 {
+			d.SetDialer(second)
+		}
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&first.count)+atomic.LoadInt32(&second.count) == 0 {
+		t.Fatal("no dialer is used")
+	}
+
+	// Dials after the swap use the replacement, even to an address whose
+	// client conn is cached.
+	d = &Dialer{NextDialer: first, ServerName: "example.com"}
+	if _, err := d.Dial("tcp", "127.0.0.1:20000"); err == nil {
+		t.Fatal("expected dial error")
+	}
+	if first.dialed("127.0.0.1:20000") == 0 {
+		t.Fatal("the dialer is not used")
+	}
+	d.SetDialer(second)
+	if _, err := d.Dial("tcp", "127.0.0.1:20000"); err == nil {
+		t.Fatal("expected dial error")
+	}
+	if second.dialed("127.0.0.1:20000") == 0 {
+		t.Fatal("replacement dialer is not used")
+	}
+}
+
+type echoGunServer struct {
+	proto.UnimplementedGunServiceServer
+}
+
+func (*echoGunServer) Tun(tun proto.GunService_TunServer) error {
+	for {
+		hunk, err := tun.Recv()
+		if err != nil {
+			return nil
+		}
+		if err = tun.Send(hunk); err != nil {
+			return err
+		}
+	}
+}
+
+// rejectingGunServer ends each tun with a status and a binary trailer after
+// the first hunk.
+type rejectingGunServer struct {
+	proto.UnimplementedGunServiceServer
+}
+
+func (*rejectingGunServer) Tun(tun proto.GunService_TunServer) error {
+	if _, err := tun.Recv(); err != nil {
+		return err
+	}
+	tun.SetTrailer(metadata.Pairs("reason-bin", "\x00\x01quota"))
+	return status.Error(codes.PermissionDenied, "quota exceeded")
+}
+
+// newTestGunServer serves the gun service under serviceName without TLS.
+func newTestGunServer(t *testing.T, serviceName string, srv proto.GunServiceServer) (addr string, stop func()) {
+	return newTestGunServerAt(t, "127.0.0.1:0", serviceName, srv)
+}
+
+func newTestGunServerAt(t *testing.T, addr string, serviceName string, srv proto.GunServiceServer) (string, func()) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	proto.RegisterGunServiceServerX(s, srv, serviceName)
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	return lis.Addr().String(), s.Stop
+}
+
+func dialTestTun(t *testing.T, addr string, serviceName string) *ClientConn {
+	conn, err := dialTestTunContext(context.Background(), addr, serviceName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func dialTestTunContext(ctx context.Context, addr string, serviceName string) (*ClientConn, error) {
+	cc, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	// As with Dialer.DialContext, ctx is not the lifetime of the tun.
+	ctxStream, cancel := context.WithCancel(context.Background())
+	tun, err := proto.NewGunServiceClient(cc).(proto.GunServiceClientX).TunCustomName(ctxStream, serviceName)
+	if err != nil {
+		cancel()
+		_ = cc.Close()
+		return nil, err
+	}
+	conn := NewClientConn(tun, func() {
+		cancel()
+		_ = cc.Close()
+	})
+	conn.path = "/" + serviceName + "/Tun"
+	return conn, nil
+}
+
+func TestServiceNotFound(t *testing.T) {
+	addr, stop := newTestGunServer(t, "RealService", &echoGunServer{})
+	defer stop()
+
+	conn := dialTestTun(t, addr, "RealService")
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "ping" {
+		t.Fatal(string(buf[:n]), err)
+	}
+	conn.Close()
+
+	conn = dialTestTun(t, addr, "WrongService")
+	defer conn.Close()
+	_, _ = conn.Write([]byte("ping"))
+	_, err = conn.Read(buf)
+	if !errors.Is(err, ErrServiceNotFound) || !strings.Contains(err.Error(), "/WrongService/Tun") {
+		t.Fatal(err)
+	}
+}
+
+func TestStatusTrailer(t *testing.T) {
+	addr, stop := newTestGunServer(t, "Rejecting", &rejectingGunServer{})
+	defer stop()
+
+	conn := dialTestTun(t, addr, "Rejecting")
+	defer conn.Close()
+	if conn.Trailer() != nil {
+		t.Fatal("trailer before the end of the tun", conn.Trailer())
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := conn.Read(make([]byte, 16))
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != codes.PermissionDenied || statusErr.Message != "quota exceeded" {
+		t.Fatal(err)
+	}
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatal(status.Code(err))
+	}
+	for _, trailer := range []metadata.MD{statusErr.Trailer, netproxy.Conn(conn).(TrailerConn).Trailer()} {
+		if reason := trailer.Get("reason-bin"); len(reason) != 1 || reason[0] != "\x00\x01quota" {
+			t.Fatal("unexpected trailer", trailer)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	capabilities := netproxy.DialerCapabilities(&Dialer{})
+	if !capabilities.Has(netproxy.CapabilityTcp|netproxy.CapabilityContext) || capabilities.Has(netproxy.CapabilityUdp) {
+		t.Fatal("unexpected capabilities", capabilities)
+	}
+}
+
+func TestSupervisedConn(t *testing.T) {
+	addr, stop := newTestGunServer(t, "Supervised", &echoGunServer{})
+	conn, err := NewSupervisedConn(context.Background(), func(ctx context.Context) (netproxy.Conn, error) {
+		return dialTestTunContext(ctx, addr, "Supervised")
+	}, SuperviseOption{Backoff: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 16)
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Fatal(string(buf[:n]), err)
+	}
+
+	// Kill the backend and bring it back on the same address.
+	stop()
+	_, stop = newTestGunServerAt(t, addr, "Supervised", &echoGunServer{})
+	defer stop()
+
+	// The write that finds the tunnel broken is sent again through the new
+	// tunnel. Writes before it may be lost with the old tunnel.
+	for i := 0; i < 100 && conn.Reconnects() == 0; i++ {
+		if _, err = conn.Write([]byte("pong")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Fatal(string(buf[:n]), err)
+	}
+	if conn.Reconnects() != 1 {
+		t.Fatal("unexpected reconnects", conn.Reconnects())
+	}
+}
+
+func TestSupervisedConnMaxAttempts(t *testing.T) {
+	addr, stop := newTestGunServer(t, "Supervised", &echoGunServer{})
+	var dials int32
+	conn, err := NewSupervisedConn(context.Background(), func(ctx context.Context) (netproxy.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return dialTestTunContext(ctx, addr, "Supervised")
+	}, SuperviseOption{MaxAttempts: 3, Backoff: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stop()
+	if _, err = conn.Read(make([]byte, 16)); err == nil {
+		t.Fatal("expected an error")
+	}
+	if dials := atomic.LoadInt32(&dials); dials != 4 {
+		t.Fatal("unexpected dials", dials)
+	}
+	if conn.Reconnects() != 0 {
+		t.Fatal("unexpected reconnects", conn.Reconnects())
+	}
+}
+
+func TestSupervisedConnDeadlineInterruptsReconnect(t *testing.T) {
+	client, server := net.Pipe()
+	var dials int32
+	conn, err := NewSupervisedConn(context.Background(), func(ctx context.Context) (netproxy.Conn, error) {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return client, nil
+		}
+		// Redials hang until they are given up.
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, SuperviseOption{Backoff: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 16))
+		readErr <- err
+	}()
+	_ = server.Close()
+	for atomic.LoadInt32(&dials) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	// Setting a deadline does not wait for the reconnection, and it ends the
+	// reconnection.
+	set := make(chan error, 1)
+	go func() {
+		set <- conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	}()
+	select {
+	case <-set:
+	case <-time.After(time.Second):
+		t.Fatal("the deadline is blocked by the reconnection")
+	}
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("unexpected error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the read is not interrupted")
+	}
+	if conn.Reconnects() != 0 {
+		t.Fatal("unexpected reconnects", conn.Reconnects())
+	}
+}
+
+// pipeListener accepts the conns sent to it.
+type pipeListener struct {
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func newTestTlsConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestUpgrade(t *testing.T) {
+	tlsConfig := newTestTlsConfig(t)
+	var negotiated string
+	var mu sync.Mutex
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		mu.Lock()
+		defer mu.Unlock()
+		negotiated = state.NegotiatedProtocol
+		return nil
+	}
+	lis := &pipeListener{conns: make(chan net.Conn, 1), closed: make(chan struct{})}
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	proto.RegisterGunServiceServerX(s, &echoGunServer{}, "Upgraded")
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	defer s.Stop()
+
+	client, server := net.Pipe()
+	lis.conns <- server
+	d := &Dialer{ServiceName: "Upgraded", ServerName: "example.com", AllowInsecure: true}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := d.Upgrade(ctx, client, "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	mu.Lock()
+	if negotiated != "h2" {
+		t.Fatal("unexpected ALPN", negotiated)
+	}
+	mu.Unlock()
+	if err = conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatal(string(buf))
+	}
+}
+
+func TestTracingDialer(t *testing.T) {
+	defer closeGlobalClientConns()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(newTestTlsConfig(t))))
+	proto.RegisterGunServiceServerX(s, &echoGunServer{}, "Traced")
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	defer s.Stop()
+
+	var mu sync.Mutex
+	var phases []string
+	var times []time.Time
+	var errs []error
+	record := func(phase string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		phases = append(phases, phase)
+		times = append(times, time.Now())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", phase, err))
+		}
+	}
+	d := &Dialer{ServiceName: "Traced", ServerName: "example.com", AllowInsecure: true}
+	d.SetDialer(direct.SymmetricDirect)
+	tracingDialer := &netproxy.TracingDialer{
+		Dialer: d,
+		Trace: &netproxy.DialTrace{
+			DialStart:     func(network string, addr string) { record("start", nil) },
+			ConnectDone:   func(err error) { record("connect", err) },
+			HandshakeDone: func(err error) { record("handshake", err) },
+			AuthDone:      func(err error) { record("auth", err) },
+			DialDone:      func(c netproxy.Conn, err error) { record("done", err) },
+		},
+	}
+	conn, err := tracingDialer.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	// gRPC has no authentication.
+	if strings.Join(phases, ",") != "start,connect,handshake,done" {
+		t.Fatal("unexpected phases", phases)
+	}
+	for i := 1; i < len(times); i++ {
+		if times[i].Before(times[i-1]) {
+			t.Fatal("phases are not in time order", phases[i])
+		}
+	}
+	if elapsed := times[len(times)-1].Sub(times[0]); elapsed > 5*time.Second {
+		t.Fatal("unexpected dial time", elapsed)
+	}
+}
@@ -0,0 +1,306 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daeuniverse/softwind/netproxy"
+)
+
+const (
+	DefaultSuperviseMaxAttempts = 5
+	DefaultSuperviseBackoff     = 200 * time.Millisecond
+	DefaultSuperviseMaxBackoff  = 5 * time.Second
+)
+
+// SuperviseOption controls the reconnection of a SupervisedConn. Zero fields
+// take the defaults.
+type SuperviseOption struct {
+	// MaxAttempts is the max number of dials for one reconnection.
+	MaxAttempts int
+	// Backoff is the delay before the second dial, which doubles for each
+	// following dial up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// SupervisedConn is a gRPC tunnel that re-dials in place when the tunnel
+// fails, so that the caller keeps using the same conn. Data in flight when the
+// tunnel fails is lost, so it only suits protocols that tolerate it. The tunnel
+// never ends by itself: the caller closes it.
+type SupervisedConn struct {
+	reconnects uint64
+
+	dial   func(ctx context.Context) (netproxy.Conn, error)
+	option SuperviseOption
+
+	// mu guards the fields below. It is not held while reconnecting, so that
+	// deadlines and Close can interrupt a reconnection.
+	mu            sync.Mutex
+	conn          netproxy.Conn
+	generation    uint64
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// deadlineSet is closed and replaced when a deadline is set.
+	deadlineSet chan struct{}
+	// reconnecting is closed once the reconnection in progress is done. It is
+	// nil if there is none.
+	reconnecting chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// DialSupervised dials a SupervisedConn, which re-dials with d on failure.
+func (d *Dialer) DialSupervised(ctx context.Context, network string, address string, option SuperviseOption) (*SupervisedConn, error) {
+	return NewSupervisedConn(ctx, func(ctx context.Context) (netproxy.Conn, error) {
+		return d.DialContext(ctx, network, address)
+	}, option)
+}
+
+// NewSupervisedConn dials a conn with dial and supervises it.
+func NewSupervisedConn(ctx context.Context, dial func(ctx context.Context) (netproxy.Conn, error), option SuperviseOption) (*SupervisedConn, error) {
+	if option.MaxAttempts <= 0 {
+		option.MaxAttempts = DefaultSuperviseMaxAttempts
+	}
+	if option.Backoff <= 0 {
+		option.Backoff = DefaultSuperviseBackoff
+	}
+	if option.MaxBackoff <= 0 {
+		option.MaxBackoff = DefaultSuperviseMaxBackoff
+	}
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &SupervisedConn{
+		dial:        dial,
+		option:      option,
+		conn:        conn,
+		deadlineSet: make(chan struct{}),
+		closed:      make(chan struct{}),
+	}, nil
+}
+
+func (c *SupervisedConn) current() (netproxy.Conn, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn, c.generation
+}
+
+// isFatal reports whether err of the tunnel calls for a reconnection.
+// Deadlines are not failures of the tunnel.
+func isFatal(err error) bool {
+	return err != nil && !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, ErrServiceNotFound)
+}
+
+// reconnect replaces the conn of generation unless it is replaced already.
+// Only one reconnection runs at a time, and others wait for it. Both are
+// bounded by the earlier of the read and the write deadline.
+func (c *SupervisedConn) reconnect(generation uint64, cause error) error {
+	c.mu.Lock()
+	for c.reconnecting != nil {
+		reconnecting := c.reconnecting
+		c.mu.Unlock()
+		if err := c.wait(reconnecting); err != nil {
+			return err
+		}
+		c.mu.Lock()
+	}
+	if c.generation != generation {
+		c.mu.Unlock()
+		return nil
+	}
+	old := c.conn
+	reconnecting := make(chan struct{})
+	c.reconnecting = reconnecting
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.reconnecting = nil
+		c.mu.Unlock()
+		close(reconnecting)
+	}()
+	_ = old.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var stopErr error
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := c.wait(ctx.Done()); err != nil {
+			stopErr = err
+			cancel()
+		}
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+	backoff := c.option.Backoff
+	err := cause
+	for attempt := 0; attempt < c.option.MaxAttempts && ctx.Err() == nil; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				continue
+			}
+			if backoff *= 2; backoff > c.option.MaxBackoff {
+				backoff = c.option.MaxBackoff
+			}
+		}
+		var conn netproxy.Conn
+		if conn, err = c.dial(ctx); err != nil {
+			continue
+		}
+		c.mu.Lock()
+		if !c.readDeadline.IsZero() {
+			_ = conn.SetReadDeadline(c.readDeadline)
+		}
+		if !c.writeDeadline.IsZero() {
+			_ = conn.SetWriteDeadline(c.writeDeadline)
+		}
+		c.conn = conn
+		c.generation++
+		c.mu.Unlock()
+		atomic.AddUint64(&c.reconnects, 1)
+		if c.isClosed() {
+			_ = conn.Close()
+		}
+		return nil
+	}
+	if ctx.Err() != nil {
+		cancel()
+		<-stopped
+		return stopErr
+	}
+	return err
+}
+
+// wait waits for done. It returns net.ErrClosed once c is closed and
+// os.ErrDeadlineExceeded once the earlier of the read and the write deadline
+// is exceeded, following the deadlines set in the meantime.
+func (c *SupervisedConn) wait(done <-chan struct{}) error {
+	for {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		if deadline.IsZero() || (!c.writeDeadline.IsZero() && c.writeDeadline.Before(deadline)) {
+			deadline = c.writeDeadline
+		}
+		deadlineSet := c.deadlineSet
+		c.mu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		var err error
+		select {
+		case <-done:
+		case <-c.closed:
+			err = net.ErrClosed
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-deadlineSet:
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		return err
+	}
+}
+
+// Reconnects returns the number of times the tunnel is re-dialed.
+func (c *SupervisedConn) Reconnects() uint64 {
+	return atomic.LoadUint64(&c.reconnects)
+}
+
+func (c *SupervisedConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *SupervisedConn) Read(p []byte) (n int, err error) {
+	for {
+		if c.isClosed() {
+			return 0, io.EOF
+		}
+		conn, generation := c.current()
+		n, err = conn.Read(p)
+		if n > 0 || !isFatal(err) || c.isClosed() {
+			return n, err
+		}
+		if err = c.reconnect(generation, err); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *SupervisedConn) Write(p []byte) (n int, err error) {
+	for {
+		if c.isClosed() {
+			return 0, io.EOF
+		}
+		conn, generation := c.current()
+		n, err = conn.Write(p)
+		if !isFatal(err) || c.isClosed() {
+			return n, err
+		}
+		if err = c.reconnect(generation, err); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *SupervisedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	conn, _ := c.current()
+	return conn.Close()
+}
+
+func (c *SupervisedConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *SupervisedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.notifyDeadline()
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *SupervisedConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.notifyDeadline()
+	return c.conn.SetWriteDeadline(t)
+}
+
+// notifyDeadline wakes up wait for a new deadline. c.mu must be held.
+func (c *SupervisedConn) notifyDeadline() {
+	close(c.deadlineSet)
+	c.deadlineSet = make(chan struct{})
+}